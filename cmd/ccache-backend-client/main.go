@@ -22,7 +22,7 @@ var BACKEND_TYPE string
 func StartServer() {
 	server, err := app.NewServer(tlv.SOCKET_PATH, tlv.FIXED_BUF_SIZE, BACKEND_TYPE)
 	if err != nil {
-		WARN(err.Error())
+		WARN("%s", err.Error())
 		panic("starting server failed!")
 	}
 
@@ -2,10 +2,13 @@ package app
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 
+	"ccache-backend-client/internal/constants"
 	//lint:ignore ST1001 for clean LOG operations
 	. "ccache-backend-client/internal/logger"
 	storage "ccache-backend-client/internal/storage"
@@ -20,12 +23,46 @@ type ConnectionHandler struct {
 	parser         *tlv.Parser
 	buffer         []byte
 	reader         *bufio.Reader
-	resetTimer     func() // callback to reset server's inactivity timer
+	budget         *storage.MemoryBudget
+	reserved       int64           // of the budget, for the message being received
+	session        storage.Session // agreed on by the Setup handshake
+	resetTimer     func()          // callback to reset server's inactivity timer
 }
 
 // ConnectionHandlerFactory creates connection handlers with proper resource management
 type ConnectionHandlerFactory struct {
 	backendType string
+	budget      *storage.MemoryBudget // shared by all connections
+}
+
+// overBudgetBackend fails the requests rejected by the memory budget, so
+// their response is built like any other.
+type overBudgetBackend struct{}
+
+var errOverBudget = &storage.BackendFailure{Message: "memory budget exhausted", Code: 0}
+
+func (overBudgetBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	return nil, 0, errOverBudget
+}
+
+func (overBudgetBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	return false, errOverBudget
+}
+
+func (overBudgetBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return false, errOverBudget
+}
+
+func (overBudgetBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	return false, errOverBudget
+}
+
+func (overBudgetBackend) Stat(ctx context.Context, key []byte) (storage.ObjectInfo, error) {
+	return storage.ObjectInfo{}, errOverBudget
+}
+
+func (overBudgetBackend) ResolveProtocolCode(code int) storage.StatusCode {
+	return storage.LOCAL_ERR
 }
 
 var readerPool = sync.Pool{
@@ -42,11 +79,16 @@ func GetBufioReader(conn net.Conn) *bufio.Reader {
 
 func PutBufioReader(reader *bufio.Reader) {
 	// reader.Reset(nil) // this causes reallocation
-	readerPool.Put(reader)
+	if reader.Size() == tlv.FIXED_BUF_SIZE {
+		readerPool.Put(reader)
+	}
 }
 
 func NewConnectionHandlerFactory(backendstr string) *ConnectionHandlerFactory {
-	return &ConnectionHandlerFactory{backendType: backendstr}
+	return &ConnectionHandlerFactory{
+		backendType: backendstr,
+		budget:      storage.NewMemoryBudget(storage.BackendAttributes),
+	}
 }
 
 func (f *ConnectionHandlerFactory) CreateHandler(conn net.Conn, resetTimer func()) (*ConnectionHandler, error) {
@@ -61,6 +103,8 @@ func (f *ConnectionHandlerFactory) CreateHandler(conn net.Conn, resetTimer func(
 		serializer:     tlv.GetSerializer(),
 		parser:         tlv.NewParser(),
 		reader:         GetBufioReader(conn),
+		budget:         f.budget,
+		session:        storage.DefaultSession(),
 		resetTimer:     resetTimer,
 	}, nil
 }
@@ -85,9 +129,12 @@ func (h *ConnectionHandler) Process() {
 	fd := h.getConnectionID()
 	LOG("Processing connection: %s", fd)
 
-	readBuffer := make([]byte, tlv.FIXED_BUF_SIZE)
+	readBuffer := make([]byte, h.session.BufferSize)
 
 	for {
+		if len(readBuffer) != int(h.session.BufferSize) {
+			readBuffer = make([]byte, h.session.BufferSize)
+		}
 		if !h.readAndAccumulate(readBuffer) {
 			LOG("Connection closed: %s", fd)
 			return
@@ -125,25 +172,93 @@ func (h *ConnectionHandler) readAndAccumulate(readBuffer []byte) bool {
 }
 
 // processAccumulatedData attempts to parse and handle complete packets
+//
+// A value is not accumulated: once the fields before it are complete, the
+// backend reads it from the connection.
 func (h *ConnectionHandler) processAccumulatedData() bool {
-	packet, err := h.parser.Parse(h.buffer)
+	packet, err := h.parser.ParseStream(h.buffer, h.reader)
 	if err != nil {
-		// Not enough data yet, continue reading
+		// Not enough data yet, continue reading once the memory budget
+		// admits the fields announced so far.
+		if !h.reserve(int64(tlv.DeclaredSize(h.buffer))) {
+			LOG("Message exceeds the memory budget, closing connection")
+			h.releaseReserved()
+			h.conn.Close()
+		}
 		return false
 	}
 
 	LOG("Received packet: %v", packet.Fields)
 
-	if h.handlePacket(packet) {
-		h.buffer = h.buffer[:0] // Reset buffer after successful processing
+	admitted := h.reserve(h.requestCost(packet))
+	defer h.releaseReserved()
+
+	handled := h.handlePacket(packet, admitted)
+	if packet.Value != nil {
+		// Skip what the backend left unread to reach the next message.
+		if _, err := io.Copy(io.Discard, packet.Value); err != nil {
+			LOG("Failed to read the rest of the value, closing connection: %v", err)
+			h.conn.Close()
+		}
+		h.resetBuffer()
+		return handled
+	}
+
+	if handled {
+		h.resetBuffer() // Reset buffer after successful processing
 		return true
 	}
 
 	return false
 }
 
-// handlePacket processes a complete TLV packet
-func (h *ConnectionHandler) handlePacket(packet *tlv.Message) bool {
+// requestCost returns the memory charged to the budget for packet: the
+// bytes buffered for it, and the value of a Put, which the backend may read
+// into memory.
+func (h *ConnectionHandler) requestCost(packet *tlv.Message) int64 {
+	cost := int64(len(h.buffer))
+	if value := packet.FindField(constants.TypeValue); value != nil && packet.Value != nil {
+		cost += int64(value.Length)
+	}
+	return cost
+}
+
+// reserve makes sure size bytes of the memory budget are reserved for the
+// message being received, before they are read.
+func (h *ConnectionHandler) reserve(size int64) bool {
+	if size <= h.reserved {
+		return true
+	}
+	if !h.budget.Acquire(size - h.reserved) {
+		return false
+	}
+	h.reserved = size
+	return true
+}
+
+// releaseReserved returns the memory reserved for a message once it is
+// handled or dropped.
+func (h *ConnectionHandler) releaseReserved() {
+	if h.reserved == 0 {
+		return
+	}
+	h.budget.Release(h.reserved)
+	h.reserved = 0
+}
+
+// resetBuffer empties the buffer for the next message. A buffer grown by a
+// large message is released rather than kept for the connection's lifetime.
+func (h *ConnectionHandler) resetBuffer() {
+	if cap(h.buffer) > constants.MAX_POOLED_BUFFER_SIZE {
+		h.buffer = nil
+		return
+	}
+	h.buffer = h.buffer[:0]
+}
+
+// handlePacket processes a complete TLV packet. A packet which wasn't
+// admitted by the memory budget is answered with a local error.
+func (h *ConnectionHandler) handlePacket(packet *tlv.Message, admitted bool) bool {
 	message, err := storage.Assemble(packet)
 	if err != nil {
 		LOG("Failed to assemble message: %v", err)
@@ -154,22 +269,61 @@ func (h *ConnectionHandler) handlePacket(packet *tlv.Message) bool {
 		return false
 	}
 
-	// TODO:
-	// Next optimisation my be to add the reader to the Handle
-	// such that the bytes can be instantly copied to backend
-	// connection
-	LOG("Handling packet via backend")
-	h.backendHandler.Handle(message)
+	// The response is sent within the deadline too, as a value returned by
+	// the backend is read while it is sent.
+	ctx, cancel := h.requestContext()
+	defer cancel()
+
+	if budgeted, ok := message.(storage.BudgetedMessage); ok {
+		budgeted.SetMemoryBudget(h.budget)
+	}
+	if admitted {
+		LOG("Handling packet via backend")
+		h.backendHandler.Handle(ctx, message)
+	} else {
+		message.WriteToBackend(ctx, overBudgetBackend{})
+	}
+
+	if setup, ok := message.(*storage.SetupMessage); ok && setup.ReadStatus() == storage.SUCCESS {
+		h.applySession(setup.Session())
+	}
 
 	LOG("Sending response")
 	return h.sendResponse(message)
 }
 
-// sendResponse serializes and sends the response back to the client
+// applySession puts the parameters agreed on in the Setup handshake into
+// effect. The connection is read in chunks of the buffer size from then on;
+// the reader keeps its size if it already holds the next message.
+func (h *ConnectionHandler) applySession(session storage.Session) {
+	h.session = session
+	LOG("Session set up: %s", h.session)
+
+	if size := int(session.BufferSize); size != h.reader.Size() && h.reader.Buffered() == 0 {
+		PutBufioReader(h.reader)
+		h.reader = bufio.NewReaderSize(h.conn, size)
+	}
+}
+
+// requestContext returns the context of a request, bounded by the operation
+// timeout agreed on in the Setup handshake, if any.
+func (h *ConnectionHandler) requestContext() (context.Context, context.CancelFunc) {
+	if h.session.OperationTimeout > 0 {
+		return context.WithTimeout(context.Background(), h.session.OperationTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// sendResponse serializes and sends the response back to the client.
+//
+// A response failing midway may already be partially sent. The connection
+// is closed then, so the client sees an error instead of accepting the
+// truncated response.
 func (h *ConnectionHandler) sendResponse(message storage.Message) bool {
 	err := message.WriteToSocket(h.conn, h.serializer)
 	if err != nil {
-		LOG("Failed to send response: %v", err)
+		LOG("Failed to send response, closing connection: %v", err)
+		h.conn.Close()
 		return false
 	}
 	return true
@@ -187,11 +341,13 @@ func (h *ConnectionHandler) getConnectionID() string {
 
 // cleanup releases all resources associated with this connection handler
 func (h *ConnectionHandler) Cleanup() {
+	h.releaseReserved()
+
 	if h.serializer != nil {
 		tlv.PutSerializer(h.serializer)
 	}
 
 	if h.reader != nil {
-		readerPool.Put(h.reader)
+		PutBufioReader(h.reader)
 	}
 }
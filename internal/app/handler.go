@@ -1,9 +1,11 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
 
 	//lint:ignore ST1001 for clean LOG operations
 	. "ccache-backend-client/internal/logger"
@@ -11,19 +13,80 @@ import (
 )
 
 type Handler interface {
-	Handle(storage.Message)
+	Handle(context.Context, storage.Message)
 }
 
 type BackendHandler struct {
 	node storage.Backend
 }
 
+var (
+	nodesMu sync.Mutex
+	nodes   = make(map[string]storage.Backend)
+)
+
 // The URL's prefix (scheme) determines which backend implementation to instantiate.
 //
 // Supported schemes:
 //   - "http": Creates an HTTP backend.
 //   - "gs": Creates a Google Cloud Storage (GCS) backend.
+//   - "redis", "rediss": Creates a Redis backend (rediss uses TLS).
+//   - "s3": Creates an S3-compatible object storage backend.
+//   - "file": Creates a backend storing entries in a local directory.
+//   - "grpc", "grpcs", "bazel+grpc", "bazel+grpcs": Creates a Bazel Remote
+//     Execution API (ActionCache/CAS) backend.
+//   - "azblob": Creates an Azure Blob Storage backend.
+//
+// storage_url may list several whitespace separated URLs, whose backends are
+// combined by storage.CombineBackends. The backend of each URL is wrapped
+// with the failure handling layers, see storage.WrapRemote, and the result
+// with the optional layers enabled by the backend attributes, see
+// storage.WrapBackend.
 func NewBackendHandler(storage_url string) (*BackendHandler, error) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+
+	if node, ok := nodes[storage_url]; ok {
+		return &BackendHandler{node: node}, nil
+	}
+
+	var node storage.Backend
+	if urls := strings.Fields(storage_url); len(urls) > 1 {
+		members := make([]storage.Backend, len(urls))
+		for i, u := range urls {
+			member, err := newBackendNode(u)
+			if err != nil {
+				return nil, err
+			}
+			members[i] = storage.WrapRemote(member, storage.BackendAttributes)
+		}
+		node = storage.CombineBackends(urls, members, storage.BackendAttributes)
+	} else {
+		var err error
+		node, err = newBackendNode(storage_url)
+		if err != nil {
+			return nil, err
+		}
+		node = storage.WrapRemote(node, storage.BackendAttributes)
+	}
+
+	// Wrapping backends keep state shared by all connections, so the
+	// node is only built once per URL.
+	node, err := storage.WrapBackend(node, storage.BackendAttributes)
+	if err != nil {
+		return nil, err
+	}
+	nodes[storage_url] = node
+	return &BackendHandler{node: node}, nil
+}
+
+// newBackendNode creates the backend of a single URL. Each call creates a new
+// instance, as several URLs of the same scheme may be combined.
+//
+// Constructors which can't set up their client from the URL and attributes
+// return nil. As a nil pointer would be a non-nil storage.Backend, it is
+// turned into an error here.
+func newBackendNode(storage_url string) (storage.Backend, error) {
 	prefix := strings.Split(storage_url, ":")[0]
 
 	furl, err := url.Parse(storage_url)
@@ -33,19 +96,50 @@ func NewBackendHandler(storage_url string) (*BackendHandler, error) {
 
 	switch prefix {
 	case "http":
-		return &BackendHandler{
-			node: storage.GetHttpBackend(furl, storage.BackendAttributes)}, nil
+		return storage.NewHTTPBackend(furl, storage.BackendAttributes), nil
 	case "gs":
-		return &BackendHandler{
-			node: storage.GetGCSBackend(furl, storage.BackendAttributes)}, nil
+		if node := storage.NewGCSBackend(furl, storage.BackendAttributes); node != nil {
+			return node, nil
+		}
+	case "redis", "rediss":
+		return storage.NewRedisBackend(furl, storage.BackendAttributes), nil
+	case "s3":
+		if node := storage.NewS3Backend(furl, storage.BackendAttributes); node != nil {
+			return node, nil
+		}
+	case "file":
+		return storage.NewFileBackend(furl, storage.BackendAttributes), nil
+	case "grpc", "grpcs", "bazel+grpc", "bazel+grpcs":
+		if node := storage.NewBazelBackend(furl, storage.BackendAttributes); node != nil {
+			return node, nil
+		}
+	case "azblob":
+		if node := storage.NewAzureBackend(furl, storage.BackendAttributes); node != nil {
+			return node, nil
+		}
 	default:
 		return nil, fmt.Errorf("backend not implemented for prefix: %s", prefix)
 	}
+	return nil, fmt.Errorf("invalid configuration for %s backend %s", prefix, furl.Redacted())
+}
+
+// DrainBackends waits for the requests the backends complete in the
+// background, e.g. queued writes, so none is lost when the helper exits.
+func DrainBackends() {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+
+	for _, node := range nodes {
+		if drainer, ok := node.(storage.Drainer); ok {
+			drainer.Drain()
+		}
+	}
 }
 
-// Propagate message received to the backend server
-func (h *BackendHandler) Handle(msg storage.Message) {
-	err := msg.WriteToBackend(h.node)
+// Propagate message received to the backend server, within the deadline of
+// ctx
+func (h *BackendHandler) Handle(ctx context.Context, msg storage.Message) {
+	err := msg.WriteToBackend(ctx, h.node)
 
 	if err != nil {
 		LOG("Handling message failed for backend: %v", err.Error())
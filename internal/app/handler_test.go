@@ -2,9 +2,12 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net"
+	"net/url"
+	"slices"
 	"testing"
 
 	"ccache-backend-client/internal/constants"
@@ -32,7 +35,7 @@ type mockBackend struct {
 	removeError  error
 }
 
-func (m *mockBackend) Get(key []byte) (io.ReadCloser, int64, error) {
+func (m *mockBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
 	// Simulate Get call adding data to serializer
 	m.getCalled = true
 	if m.getError != nil {
@@ -42,16 +45,26 @@ func (m *mockBackend) Get(key []byte) (io.ReadCloser, int64, error) {
 	return io.NopCloser(bytes.NewReader(mock)), int64(len(mock)), nil
 }
 
-func (m *mockBackend) Put(key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+func (m *mockBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
 	m.putCalled = true
 	return true, m.putError
 }
 
-func (m *mockBackend) Remove(key []byte) (bool, error) {
+func (m *mockBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	m.putCalled = true
+	return true, m.putError
+}
+
+func (m *mockBackend) Remove(ctx context.Context, key []byte) (bool, error) {
 	m.removeCalled = true
 	return true, m.removeError
 }
 
+func (m *mockBackend) Stat(ctx context.Context, key []byte) (storage.ObjectInfo, error) {
+	m.getCalled = true
+	return storage.ObjectInfo{Size: int64(len("mock data"))}, m.getError
+}
+
 func (m *mockBackend) ResolveProtocolCode(code int) storage.StatusCode {
 	return storage.SUCCESS
 }
@@ -70,7 +83,7 @@ func (m *mockMessage) Create(*tlv.Message) error {
 	return nil
 }
 
-func (m *mockMessage) WriteToBackend(backend storage.Backend) error {
+func (m *mockMessage) WriteToBackend(ctx context.Context, backend storage.Backend) error {
 	m.writeCalled = true
 	return m.writeError
 }
@@ -106,6 +119,54 @@ func TestNewBackendHandler(t *testing.T) {
 			url:   "gs://bucket-name",
 			isErr: false,
 		},
+		{
+			name:  "valid redis URL",
+			url:   "redis://localhost:6379/0",
+			isErr: false,
+		},
+		{
+			name:  "valid s3 URL",
+			url:   "s3://bucket-name/prefix",
+			isErr: false,
+		},
+		{
+			name:  "valid file URL",
+			url:   "file:///tmp/ccache",
+			isErr: false,
+		},
+		{
+			name:  "valid bazel URL",
+			url:   "bazel+grpc://localhost:9092/instance",
+			isErr: false,
+		},
+		{
+			name:  "valid azblob URL",
+			url:   "azblob://account/container",
+			isErr: false,
+		},
+		{
+			name:   "azblob URL without container",
+			url:    "azblob://account",
+			isErr:  true,
+			errMsg: "invalid configuration for azblob backend azblob://account",
+		},
+		{
+			name:   "URL list with invalid configuration",
+			url:    "http://example.com azblob://account",
+			isErr:  true,
+			errMsg: "invalid configuration for azblob backend azblob://account",
+		},
+		{
+			name:  "valid URL list",
+			url:   "http://regional.example.com gs://bucket-name",
+			isErr: false,
+		},
+		{
+			name:   "URL list with invalid scheme",
+			url:    "http://example.com ftp://example.com",
+			isErr:  true,
+			errMsg: "backend not implemented for prefix: ftp",
+		},
 		{
 			name:   "invalid scheme",
 			url:    "ftp://example.com",
@@ -125,6 +186,9 @@ func TestNewBackendHandler(t *testing.T) {
 		},
 	}
 
+	// Lets the GCS client start without application default credentials.
+	t.Setenv("STORAGE_EMULATOR_HOST", "localhost:9023")
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			handler, err := NewBackendHandler(tt.url)
@@ -208,7 +272,7 @@ func TestBackendHandler_Handle(t *testing.T) {
 			serializer := tlv.GetSerializer()
 
 			// Call Handle
-			handler.Handle(mockMsg)
+			handler.Handle(t.Context(), mockMsg)
 
 			// Verify message methods were called
 			if mockMsg.writeCalled != tt.expectWrite {
@@ -252,7 +316,7 @@ func TestBackendHandler_HandleIntegration(t *testing.T) {
 
 	serializer := tlv.GetSerializer()
 	// Handle the message
-	handler.Handle(mockMsg)
+	handler.Handle(t.Context(), mockMsg)
 
 	// Verify the serializer contains expected structure
 	// Should have at least: version(2) + msgtype(2) + status_field_header + status_value
@@ -283,3 +347,119 @@ func TestBackendHandler_HandleIntegration(t *testing.T) {
 		t.Errorf("Expected status code %d, got %d", uint8(storage.SUCCESS), statusField.Data[0])
 	}
 }
+
+// processPipe runs a connection handler for node on one end of a pipe and
+// returns it along with the other end, the client's.
+func processPipe(t *testing.T, node storage.Backend) (*ConnectionHandler, net.Conn) {
+	defaultSize := tlv.FIXED_BUF_SIZE
+	tlv.FIXED_BUF_SIZE = 1024
+
+	client, server := net.Pipe()
+	h := &ConnectionHandler{
+		conn:           server,
+		backendHandler: &BackendHandler{node: node},
+		serializer:     tlv.NewSerializer(1024),
+		parser:         tlv.NewParser(),
+		reader:         GetBufioReader(server),
+		session:        storage.DefaultSession(),
+		resetTimer:     func() {},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Process()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+		tlv.FIXED_BUF_SIZE = defaultSize
+	})
+	return h, client
+}
+
+// readResponse reads and parses the response to the message last sent by
+// client.
+func readResponse(t *testing.T, client net.Conn) *tlv.Message {
+	var data []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("reading the response failed: %v", err)
+		}
+		data = append(data, buf[:n]...)
+		if response, err := tlv.NewParser().Parse(data); err == nil {
+			return response
+		}
+	}
+}
+
+func TestConnectionHandler_SessionBufferSize(t *testing.T) {
+	h, client := processPipe(t, &mockBackend{})
+
+	s := tlv.NewSerializer(1024)
+	s.BeginMessage(0x01, 2, constants.MsgTypeSetup)
+	s.AddField(constants.SetupTagVersion, []byte{0x01})
+	s.AddField(constants.SetupTagBufferSize, tlv.NewUintField(constants.SetupTagBufferSize, uint32(4096)).Serialize())
+	client.Write(s.Bytes())
+
+	readResponse(t, client)
+	if size := h.reader.Size(); size != 4096 {
+		t.Errorf("reader size after Setup = %d, want the agreed 4096", size)
+	}
+}
+
+// unavailableKeyBackend fails the Get of one key with a server error.
+type unavailableKeyBackend struct {
+	storage.Backend
+	key []byte
+}
+
+func (b *unavailableKeyBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	if bytes.Equal(key, b.key) {
+		return nil, 0, &storage.BackendFailure{Message: "service unavailable", Code: 503}
+	}
+	return b.Backend.Get(ctx, key)
+}
+
+func TestConnectionHandler_BatchGet(t *testing.T) {
+	keys := [][]byte{{0x01, 0x01}, {0x01, 0x02}, {0x01, 0x03}}
+	files := storage.NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	files.Put(t.Context(), keys[0], []byte("object code"), false)
+	_, client := processPipe(t, &unavailableKeyBackend{Backend: files, key: keys[2]})
+
+	s := tlv.NewSerializer(1024)
+	s.BeginMessage(0x01, uint8(len(keys)), constants.MsgTypeBatchGet)
+	for _, key := range keys {
+		s.AddField(constants.TypeKey, key)
+	}
+	client.Write(s.Bytes())
+
+	response := readResponse(t, client)
+	if response.Type != constants.MsgTypeBatchGetResp {
+		t.Fatalf("response type = %#x, want a Batch Get response", response.Type)
+	}
+	var statuses []storage.StatusCode
+	var values, messages []string
+	for _, field := range response.Fields {
+		switch field.Tag {
+		case constants.TypeStatusCode:
+			statuses = append(statuses, storage.StatusCode(field.Data[0]))
+		case constants.TypeValue:
+			values = append(values, string(field.Data))
+		case constants.TypeErrorMsg:
+			messages = append(messages, string(field.Data))
+		}
+	}
+
+	want := []storage.StatusCode{storage.SUCCESS, storage.SUCCESS, storage.NO_FILE, storage.ERROR}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if !slices.Equal(values, []string{"object code"}) {
+		t.Errorf("values = %q, want the value of the key found", values)
+	}
+	if !slices.Equal(messages, []string{"service unavailable"}) {
+		t.Errorf("error messages = %q, want one for the failed key only", messages)
+	}
+}
@@ -92,7 +92,19 @@ func (s *SocketServer) Start() {
 	LOG("Server started, listening on: %v", s.socketPath)
 	LOG("Limiting connections to a maximum of %d clients!", constants.MAX_PARALLEL_CLIENTS)
 
-	go s.monitorInactivity(ctx, cancel)
+	monitorDone := make(chan struct{})
+	go func() {
+		defer close(monitorDone)
+		s.monitorInactivity(ctx, cancel)
+	}()
+	// However the loop ends, the connections still being served may queue
+	// writes. The backends are drained once they are done, so none is lost.
+	defer func() {
+		cancel()
+		<-monitorDone
+		s.wg.Wait()
+		DrainBackends()
+	}()
 
 	semaphore := make(chan struct{}, constants.MAX_PARALLEL_CLIENTS)
 
@@ -100,7 +112,6 @@ func (s *SocketServer) Start() {
 		select {
 		case <-ctx.Done():
 			LOG("Shutdown signal received! Exiting main loop.")
-			s.wg.Wait()
 			return
 		default:
 			conn, err := s.listener.Accept()
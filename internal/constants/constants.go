@@ -8,6 +8,21 @@ import (
 const (
 	INACTIVITY_TIMEOUT   = 60 * time.Second
 	MAX_PARALLEL_CLIENTS = 128
+	// Buffers grown beyond this size are released instead of being kept
+	// for reuse.
+	MAX_POOLED_BUFFER_SIZE = 1 << 20
+	// Error messages sent to ccache are truncated to this size.
+	MAX_ERROR_MSG_SIZE = 512
+)
+
+// Setup negotiation
+var SUPPORTED_VERSIONS = []uint8{0x01} // highest last
+
+const (
+	MIN_OPERATION_TIMEOUT = 100 * time.Millisecond
+	MAX_OPERATION_TIMEOUT = 5 * time.Minute
+	MIN_BUFFER_SIZE       = 1024
+	MAX_BUFFER_SIZE       = MAX_POOLED_BUFFER_SIZE
 )
 
 // Message types
@@ -16,12 +31,24 @@ const (
 	MsgTypeGet            uint16 = 0x02
 	MsgTypePut            uint16 = 0x03
 	MsgTypeDelete         uint16 = 0x04
+	MsgTypeStat           uint16 = 0x05
+	MsgTypeBatchGet       uint16 = 0x06
+	MsgTypeBatchPut       uint16 = 0x07
+	MsgTypeBatchDelete    uint16 = 0x08
 	MsgTypeSetupReponse   uint16 = 0x8001
 	MsgTypeGetResponse    uint16 = 0x8002
 	MsgTypePutResponse    uint16 = 0x8003
 	MsgTypeDeleteResponse uint16 = 0x8004
+	MsgTypeStatResponse   uint16 = 0x8005
+	MsgTypeBatchGetResp   uint16 = 0x8006
+	MsgTypeBatchPutResp   uint16 = 0x8007
+	MsgTypeBatchDelResp   uint16 = 0x8008
 )
 
+// Keys of a batch message, so its response fits the field count of the
+// header (a status and a value or error message per key).
+const MAX_BATCH_SIZE = 64
+
 // Field types
 const (
 	SetupTagVersion          uint8 = 0x01
@@ -36,6 +63,7 @@ const (
 	TypeStatusCode uint8 = 0x084
 	TypeErrorMsg   uint8 = 0x085
 	TypeFlags      uint8 = 0x086
+	TypeSize       uint8 = 0x087
 )
 
 // Flags
@@ -0,0 +1,400 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	urlib "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const azureApiVersion = "2021-08-06"
+
+// Failure codes of the Azure backend. Azure reports errors as strings in the
+// x-ms-error-code header, azureFailureCode maps them onto these.
+const (
+	azureLocalError = iota
+	azureNotFound
+	azureTimeout
+	azureServerBusy
+	azureAuthFailed
+	azureConflict
+	azureError
+	azureUnreachable
+)
+
+type AzureAttributes struct {
+	Endpoint          string
+	AccountKey        string
+	SASToken          string
+	connectionTimeout time.Duration
+	operationTimeout  time.Duration
+}
+
+type AzureStorageBackend struct {
+	client        *http.Client
+	accountName   string
+	containerName string
+	location      string
+	endpoint      urlib.URL
+	accountKey    []byte
+	sasToken      urlib.Values
+}
+
+// NewAzureBackend creates a backend for URLs of the form
+// azblob://ACCOUNT/CONTAINER[/PREFIX].
+//
+// Requests are authorized with the "sas-token" attribute if set, otherwise
+// with Shared Key using the base64 encoded "account-key" attribute.
+func NewAzureBackend(url *urlib.URL, attributes []Attribute) *AzureStorageBackend {
+	defaultAttrs := &AzureAttributes{}
+	for _, attr := range backendAttributes(attributes) {
+		switch attr.Key {
+		case "endpoint":
+			defaultAttrs.Endpoint = attr.Value
+		case "account-key":
+			defaultAttrs.AccountKey = attr.Value
+		case "sas-token":
+			defaultAttrs.SASToken = strings.TrimPrefix(attr.Value, "?")
+		case "connect-timeout":
+			defaultAttrs.connectionTimeout = parseTimeout(attr.Value)
+		case "operation-timeout":
+			defaultAttrs.operationTimeout = parseTimeout(attr.Value)
+		default:
+			LOG("Azure attribute '%s' not known!", attr.Key)
+		}
+	}
+
+	container, prefix, _ := strings.Cut(strings.Trim(url.Path, "/"), "/")
+	if container == "" {
+		LOG("Azure URL %s does not name a container", url.Redacted())
+		return nil
+	}
+
+	endpoint := defaultAttrs.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", url.Host)
+	}
+	endpointUrl, err := urlib.Parse(endpoint)
+	if err != nil || endpointUrl.Host == "" {
+		LOG("Invalid Azure endpoint '%s'", endpoint)
+		return nil
+	}
+
+	backend := &AzureStorageBackend{
+		accountName:   url.Host,
+		containerName: container,
+		location:      getObjectPrefix(&urlib.URL{Path: prefix}),
+		endpoint:      *endpointUrl,
+	}
+
+	if defaultAttrs.SASToken != "" {
+		backend.sasToken, err = urlib.ParseQuery(defaultAttrs.SASToken)
+		if err != nil {
+			LOG("Invalid Azure SAS token: %v", err)
+			return nil
+		}
+	} else if defaultAttrs.AccountKey != "" {
+		backend.accountKey, err = base64.StdEncoding.DecodeString(defaultAttrs.AccountKey)
+		if err != nil {
+			LOG("Invalid Azure account key: %v", err)
+			return nil
+		}
+	} else {
+		LOG("No Azure credentials configured, sending anonymous requests")
+	}
+
+	transport := newHttpTransport(defaultAttrs.connectionTimeout)
+	backend.client = &http.Client{Transport: transport, Timeout: defaultAttrs.operationTimeout}
+	return backend
+}
+
+// ResolveProtocolCode maps the Azure failure codes onto the protocol status.
+func (h *AzureStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	switch code {
+	case azureLocalError:
+		return LOCAL_ERR
+	case azureNotFound:
+		return NO_FILE
+	case azureTimeout:
+		return TIMEOUT
+	default:
+		return ERROR
+	}
+}
+
+// azureFailureCode classifies a failed response by its x-ms-error-code,
+// falling back to the HTTP status when the header is absent.
+func azureFailureCode(resp *http.Response) int {
+	switch resp.Header.Get("x-ms-error-code") {
+	case "BlobNotFound", "ContainerNotFound", "ResourceNotFound":
+		return azureNotFound
+	case "OperationTimedOut":
+		return azureTimeout
+	case "ServerBusy", "InternalError":
+		return azureServerBusy
+	case "AuthenticationFailed", "AuthorizationFailure", "AuthorizationPermissionMismatch", "InsufficientAccountPermissions":
+		return azureAuthFailed
+	case "BlobAlreadyExists", "ConditionNotMet":
+		return azureConflict
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return azureNotFound
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return azureTimeout
+	case http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusTooManyRequests:
+		return azureServerBusy
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return azureAuthFailed
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return azureConflict
+	}
+
+	if resp.StatusCode >= 500 {
+		return azureServerBusy
+	}
+	return azureError
+}
+
+// isServerFailure tells whether code reports a failure of the Azure service
+// or the connection to it, see isServerFailure.
+func (h *AzureStorageBackend) isServerFailure(code int) bool {
+	switch code {
+	case azureTimeout, azureServerBusy, azureUnreachable:
+		return true
+	default:
+		return false
+	}
+}
+
+// newRequest builds an authorized request for the blob stored under key.
+// Headers taking part in Shared Key signing are passed in headers.
+func (h *AzureStorageBackend) newRequest(ctx context.Context, method string, key []byte, data []byte, headers map[string]string) (*http.Request, error) {
+	blobName, err := formatDigest(key)
+	if err != nil {
+		return nil, err
+	}
+
+	u := h.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + h.containerName + "/" + h.location + blobName
+	if h.sasToken != nil {
+		u.RawQuery = h.sasToken.Encode()
+	}
+
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureApiVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	if h.sasToken == nil && h.accountKey != nil {
+		h.signSharedKey(req)
+	}
+	return req, nil
+}
+
+// signSharedKey adds a Shared Key Authorization header to req.
+func (h *AzureStorageBackend) signSharedKey(req *http.Request) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	// The account name is always prepended, even for path-style endpoints
+	// such as Azurite's which already carry it in the path.
+	resource := "/" + h.accountName + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(query[name], ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, h.accountKey)
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", "SharedKey "+h.accountName+":"+signature)
+}
+
+// Get downloads the blob stored under key.
+func (h *AzureStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	req, err := h.newRequest(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create Azure request for %x: %v", key, err),
+			Code:    azureLocalError}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, 0, h.requestFailure(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, h.failure("get", req, resp)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// Put uploads data as a block blob under key.
+//
+// When onlyIfMissing is set the upload is conditional (If-None-Match: *) and
+// an existing blob results in (false, nil).
+func (h *AzureStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	if data == nil {
+		data = []byte{}
+	}
+	headers := map[string]string{"x-ms-blob-type": "BlockBlob"}
+	if onlyIfMissing {
+		headers["If-None-Match"] = "*"
+	}
+
+	req, err := h.newRequest(ctx, "PUT", key, data, headers)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create Azure request for %x: %v", key, err),
+			Code:    azureLocalError}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, h.requestFailure(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if onlyIfMissing && azureFailureCode(resp) == azureConflict {
+			return false, nil // blob exists
+		}
+		return false, h.failure("put", req, resp)
+	}
+
+	return true, nil
+}
+
+// PutStream reads the value into memory and stores it with Put.
+func (h *AzureStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Stat reads the properties of the blob stored under key with a HEAD
+// request, without downloading it.
+func (h *AzureStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	req, err := h.newRequest(ctx, "HEAD", key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create Azure request for %x: %v", key, err),
+			Code:    azureLocalError}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return ObjectInfo{}, h.requestFailure(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ObjectInfo{}, h.failure("stat", req, resp)
+	}
+
+	info := ObjectInfo{Size: resp.ContentLength}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = modified
+	}
+	return info, nil
+}
+
+// Remove deletes the blob stored under key.
+func (h *AzureStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	req, err := h.newRequest(ctx, "DELETE", key, nil, nil)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create Azure request for %x: %v", key, err),
+			Code:    azureLocalError}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, h.requestFailure(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, h.failure("delete", req, resp)
+	}
+
+	return true, nil
+}
+
+func (h *AzureStorageBackend) failure(op string, req *http.Request, resp *http.Response) *BackendFailure {
+	return &BackendFailure{
+		Message: fmt.Sprintf("Failed to %s %s from Azure (%s %s)", op, req.URL.Path, resp.Status, resp.Header.Get("x-ms-error-code")),
+		Code:    azureFailureCode(resp)}
+}
+
+func (h *AzureStorageBackend) requestFailure(err error) *BackendFailure {
+	code := azureUnreachable
+	// Only report the underlying error, the URL may carry the SAS token.
+	if urlErr, ok := err.(*urlib.Error); ok {
+		if urlErr.Timeout() {
+			code = azureTimeout
+		}
+		err = urlErr.Err
+	}
+	return &BackendFailure{
+		Message: fmt.Sprintf("Azure request failed: %v", err),
+		Code:    code}
+}
@@ -0,0 +1,177 @@
+package backend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newFakeAzure mimics the Blob REST API for a single path-style account.
+// authorized is called for every request to check its credentials.
+func newFakeAzure(t *testing.T, authorized func(r *http.Request) bool) (*httptest.Server, map[string][]byte) {
+	var mu sync.Mutex
+	blobs := make(map[string][]byte)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !authorized(r) {
+			w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/devstoreaccount1/slow/") {
+			w.Header().Set("x-ms-error-code", "OperationTimedOut")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "GET", "HEAD":
+			data, ok := blobs[r.URL.Path]
+			if !ok {
+				w.Header().Set("x-ms-error-code", "BlobNotFound")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+		case "PUT":
+			if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if _, exists := blobs[r.URL.Path]; exists && r.Header.Get("If-None-Match") == "*" {
+				w.Header().Set("x-ms-error-code", "BlobAlreadyExists")
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			blobs[r.URL.Path], _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			if _, ok := blobs[r.URL.Path]; !ok {
+				w.Header().Set("x-ms-error-code", "BlobNotFound")
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(blobs, r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, blobs
+}
+
+func TestAzureStorageBackend_PutGetRemove(t *testing.T) {
+	tests := []struct {
+		name       string
+		attribute  Attribute
+		authorized func(r *http.Request) bool
+	}{
+		{
+			name:      "shared key",
+			attribute: Attribute{Key: "account-key", Value: "c2VjcmV0"},
+			authorized: func(r *http.Request) bool {
+				return strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey devstoreaccount1:")
+			},
+		},
+		{
+			name:      "sas token",
+			attribute: Attribute{Key: "sas-token", Value: "?sv=2021-08-06&sig=abc"},
+			authorized: func(r *http.Request) bool {
+				return r.URL.Query().Get("sig") == "abc" && r.Header.Get("Authorization") == ""
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, blobs := newFakeAzure(t, tt.authorized)
+			u, _ := url.Parse("azblob://devstoreaccount1/container/prefix")
+			backend := NewAzureBackend(u, []Attribute{
+				{Key: "endpoint", Value: server.URL + "/devstoreaccount1"},
+				tt.attribute,
+			})
+			key := []byte{0x01, 0x02, 0x03}
+
+			if _, _, err := backend.Get(t.Context(), key); err == nil {
+				t.Fatal("Get() on empty container should fail")
+			} else if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+				t.Errorf("Get() miss resolved to %d, want NO_FILE", code)
+			}
+
+			if _, err := backend.Stat(t.Context(), key); err == nil {
+				t.Fatal("Stat() on empty container should fail")
+			} else if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+				t.Errorf("Stat() miss resolved to %d, want NO_FILE", code)
+			}
+
+			if ok, err := backend.Put(t.Context(), key, []byte("value"), true); !ok || err != nil {
+				t.Fatalf("Put() = %v, %v", ok, err)
+			}
+			if ok, err := backend.Put(t.Context(), key, []byte("other"), true); ok || err != nil {
+				t.Errorf("Put() with onlyIfMissing on existing key = %v, %v", ok, err)
+			}
+
+			digest, _ := formatDigest(key)
+			if string(blobs["/devstoreaccount1/container/prefix/"+digest]) != "value" {
+				t.Errorf("blob not stored under prefixed name, have %v", blobs)
+			}
+
+			if info, err := backend.Stat(t.Context(), key); err != nil || info.Size != int64(len("value")) {
+				t.Errorf("Stat() = %+v, %v, want the size of the value", info, err)
+			}
+
+			body, size, err := backend.Get(t.Context(), key)
+			if err != nil {
+				t.Fatalf("Get() failed: %v", err)
+			}
+			data, _ := io.ReadAll(body)
+			body.Close()
+			if string(data) != "value" || size != int64(len(data)) {
+				t.Errorf("Get() = %q (size %d), want \"value\"", data, size)
+			}
+
+			if ok, err := backend.Remove(t.Context(), key); !ok || err != nil {
+				t.Errorf("Remove() = %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestAzureStorageBackend_ResolveErrorCodes(t *testing.T) {
+	server, _ := newFakeAzure(t, func(r *http.Request) bool {
+		return !strings.Contains(r.URL.Path, "/denied/")
+	})
+
+	tests := []struct {
+		container string
+		want      StatusCode
+	}{
+		{"slow", TIMEOUT},
+		{"denied", ERROR},
+		{"container", NO_FILE},
+	}
+
+	for _, tt := range tests {
+		u, _ := url.Parse("azblob://devstoreaccount1/" + tt.container)
+		backend := NewAzureBackend(u, []Attribute{{Key: "endpoint", Value: server.URL + "/devstoreaccount1"}})
+
+		_, _, err := backend.Get(t.Context(), []byte{0x01, 0x02})
+		if err == nil {
+			t.Fatalf("Get() from %s should fail", tt.container)
+		}
+		if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != tt.want {
+			t.Errorf("Get() from %s resolved to %d, want %d", tt.container, code, tt.want)
+		}
+	}
+}
@@ -1,15 +1,22 @@
 package backend
 
 import (
+	"context"
 	"encoding/base32"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	urlib "net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
 )
 
 type StatusCode uint8
@@ -27,23 +34,215 @@ const (
 type BackendFailure struct {
 	Message string
 	Code    int
+
+	// class keeps the classification of the original failure when a
+	// wrapping backend replaces its code by the protocol status.
+	class failureClass
 }
 
+type failureClass uint8
+
+const (
+	failureClassified failureClass = 1 << iota
+	failureServer
+	failureTransient
+)
+
 type Attribute struct {
 	RawValue string
 	Value    string
 	Key      string
 }
 
+// Backend stores the values of ccache. ctx is bounded by the operation
+// timeout negotiated with ccache; a value returned by Get is read within it.
 type Backend interface {
-	Get(key []byte) (io.ReadCloser, int64, error)
-	Put([]byte, []byte, bool) (bool, error)
-	Remove([]byte) (bool, error)
+	Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error)
+	Put(context.Context, []byte, []byte, bool) (bool, error)
+	// PutStream stores the size bytes read from r like Put, so large values
+	// needn't be held in memory. Backends which need the whole value at once
+	// read it with putBuffered.
+	PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error)
+	Remove(context.Context, []byte) (bool, error)
+	// Stat describes the value of key without transferring it. Backends
+	// which can't do so look it up with statByGet.
+	Stat(ctx context.Context, key []byte) (ObjectInfo, error)
 	ResolveProtocolCode(int) StatusCode
 }
 
+// ObjectInfo describes a stored value.
+type ObjectInfo struct {
+	Size         int64     // -1 if unknown
+	LastModified time.Time // zero if unknown
+}
+
+// Drainer is implemented by backends completing requests in the background,
+// and by the backends wrapping others. Drain returns once the requests
+// accepted so far are completed.
+type Drainer interface {
+	Drain()
+}
+
+// drain waits for the background requests of node, if it has any.
+func drain(node Backend) {
+	if drainer, ok := node.(Drainer); ok {
+		drainer.Drain()
+	}
+}
+
 var BackendAttributes []Attribute
 
+// WrapRemote layers the optional backends dealing with failures of a single
+// remote around node. It is applied to each URL before several are combined,
+// so a flaky member is retried on its own. The circuit breaker comes last,
+// so it counts a retried request once and an open circuit isn't retried.
+func WrapRemote(node Backend, attributes []Attribute) Backend {
+	if value := findAttribute(attributes, "retry-max-attempts"); value != "" && value != "1" {
+		node = NewRetryingBackend(node, attributes)
+	}
+	if findAttribute(attributes, "breaker-failure-threshold") != "" {
+		node = NewCircuitBreakerBackend(node, attributes)
+	}
+	return node
+}
+
+// WrapBackend layers the optional backends enabled by attributes around node.
+// Layers transforming the stored values come last, so the local cache tier
+// holds the values as they are stored remotely. Values are compressed before
+// they are encrypted, and signed and checksummed last. Concurrent requests
+// are coalesced first, so they share all the layers' work. The write-behind
+// queue is outermost, so draining the node returned uploads the queued
+// writes before waiting for those the inner backends complete.
+//
+// An error is returned if a layer can't be set up, rather than silently
+// running without it.
+func WrapBackend(node Backend, attributes []Attribute) (Backend, error) {
+	if findAttribute(attributes, "local-cache-dir") != "" {
+		node = NewTieredBackend(node, attributes)
+	}
+	if findAttribute(attributes, "verify-checksums") == "true" {
+		node = NewChecksummedBackend(node, attributes)
+	}
+	if findAttribute(attributes, "signing-key-file") != "" || findAttribute(attributes, "signing-key-env") != "" {
+		signed, err := NewSignedBackend(node, attributes)
+		if err != nil {
+			return nil, err
+		}
+		node = signed
+	}
+	if findAttribute(attributes, "encryption-key-file") != "" || findAttribute(attributes, "encryption-key-env") != "" {
+		encrypted, err := NewEncryptedBackend(node, attributes)
+		if err != nil {
+			return nil, err
+		}
+		node = encrypted
+	}
+	switch compression := findAttribute(attributes, "compression"); compression {
+	case "", "none":
+	case "zstd":
+		node = NewCompressedBackend(node, attributes)
+	default:
+		LOG("Compression '%s' not known, storing values uncompressed", compression)
+	}
+	if findAttribute(attributes, "negative-cache-ttl") != "" {
+		node = NewNegativeCacheBackend(node, attributes)
+	}
+	if findAttribute(attributes, "coalesce-requests") == "true" {
+		node = NewCoalescingBackend(node, attributes)
+	}
+	if findAttribute(attributes, "write-behind") == "true" {
+		node = NewWriteBehindBackend(node, attributes)
+	}
+	return node, nil
+}
+
+// detachedContext returns a context for work outliving the request of ctx,
+// e.g. writes completed after the response was sent. It isn't canceled with
+// ctx but keeps its deadline, or expires after timeout if ctx has none.
+func detachedContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithTimeout(detached, timeout)
+}
+
+// statByGet implements Stat for backends which can't describe a value
+// without reading it: the value is looked up by Get and closed unread. The
+// time it was stored is unknown then.
+func statByGet(ctx context.Context, b Backend, key []byte) (ObjectInfo, error) {
+	body, size, err := b.Get(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	body.Close()
+	return ObjectInfo{Size: size}, nil
+}
+
+// readValue reads the size bytes of a streamed value into memory.
+func readValue(r io.Reader, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to read value: %w", err)
+	}
+	return data, nil
+}
+
+// putBuffered implements PutStream for backends which need the whole value
+// at once, e.g. to sign it: the value is read into memory and stored by Put.
+// The failure to read it has code 0, a local error for all backends using
+// it.
+func putBuffered(ctx context.Context, b Backend, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	data, err := readValue(r, size)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to read value of %x: %v", key, err),
+			Code:    0}
+	}
+	return b.Put(ctx, key, data, onlyIfMissing)
+}
+
+// layerAttributes are the attributes of the layers wrapping a backend and of
+// the helper itself. Every backend receives them besides its own.
+var layerAttributes = []string{
+	"remote-mode", "write-to", "write-quorum", "shard-retry-interval", "replica-retry-interval",
+	"retry-max-attempts", "retry-initial-backoff", "retry-max-backoff", "retry-deadline",
+	"breaker-failure-threshold", "breaker-cool-down",
+	"local-cache-dir", "local-cache-max-size", "promote-on-hit",
+	"verify-checksums", "signing-key-file", "signing-key-env", "signing-mode",
+	"encryption-key-file", "encryption-key-env",
+	"compression", "compression-level", "compression-min-size",
+	"negative-cache-ttl", "negative-cache-size", "coalesce-requests", "coalesce-max-size",
+	"write-behind", "write-behind-workers", "write-behind-queue-size",
+	"write-behind-spill-dir", "write-behind-spill-max-size",
+	"write-behind-upload-timeout", "write-behind-drain-timeout",
+	"memory-budget", "memory-budget-wait", "batch-concurrency",
+}
+
+// backendAttributes returns the attributes meant for a backend itself,
+// leaving out those of the layers wrapping it, so backends only warn about
+// attributes nobody knows.
+func backendAttributes(attributes []Attribute) []Attribute {
+	own := make([]Attribute, 0, len(attributes))
+	for _, attr := range attributes {
+		if !slices.Contains(layerAttributes, attr.Key) {
+			own = append(own, attr)
+		}
+	}
+	return own
+}
+
+// findAttribute returns the value of the last attribute named key.
+func findAttribute(attributes []Attribute, key string) string {
+	value := ""
+	for _, attr := range attributes {
+		if attr.Key == key {
+			value = attr.Value
+		}
+	}
+	return value
+}
+
 func formatDigest(data []byte) (string, error) {
 	const base16Bytes = 2
 
@@ -57,10 +256,180 @@ func formatDigest(data []byte) (string, error) {
 	return base16Part + base32Part, nil
 }
 
+// getObjectPrefix returns the object name prefix encoded in the path of a
+// bucket URL, e.g. "gs://bucket/some/dir" yields "some/dir/".
+func getObjectPrefix(url *urlib.URL) string {
+	location := strings.Trim(url.Path, "/")
+	if location == "" {
+		return ""
+	}
+	return location + "/"
+}
+
+// parseSize interprets an attribute value as a number of bytes. Like ccache,
+// the suffixes k, M, G and T are powers of 1000 and Ki, Mi, Gi and Ti are
+// powers of 1024.
+func parseSize(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+
+	number, multiplier := strings.TrimSpace(value), int64(1)
+	for _, unit := range units {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = trimmed, unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// parseTimeout interprets an attribute value as a number of milliseconds,
+// which is the unit ccache uses for its timeout attributes.
 func parseTimeout(value string) time.Duration {
-	var timeout time.Duration
+	var timeout int64
 	fmt.Sscanf(value, "%d", &timeout)
-	return time.Duration(timeout.Seconds())
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// resolveHttpStatus maps an HTTP-like status code onto the protocol status.
+// Backends that don't speak HTTP report their failures with these codes too.
+func resolveHttpStatus(code int) StatusCode {
+	if code < 100 {
+		return LOCAL_ERR
+	} else if code == 404 {
+		return NO_FILE
+	} else if code == 408 {
+		return TIMEOUT
+	} else if code < 200 {
+		return SIGWAIT
+	} else if code < 300 {
+		return SUCCESS
+	} else if code < 400 {
+		return REDIRECT
+	} else {
+		return ERROR
+	}
+}
+
+// failureStatus returns the protocol status of an error returned by b.
+func failureStatus(b Backend, err error) StatusCode {
+	if bf, ok := err.(*BackendFailure); ok {
+		return b.ResolveProtocolCode(bf.Code)
+	}
+	return ERROR
+}
+
+// serverFailureClassifier is implemented by backends whose failure codes
+// aren't HTTP status codes, see isServerFailure.
+type serverFailureClassifier interface {
+	isServerFailure(code int) bool
+}
+
+// isServerFailure tells whether err returned by b shows that the server or
+// the connection to it failed: transport errors, timeouts and 5xx responses.
+// Misses, local errors and rejected requests (4xx) say nothing about the
+// health of the server.
+func isServerFailure(b Backend, err error) bool {
+	bf, ok := err.(*BackendFailure)
+	if !ok {
+		return true
+	}
+	if bf.class&failureClassified != 0 {
+		return bf.class&failureServer != 0
+	}
+
+	switch b.ResolveProtocolCode(bf.Code) {
+	case TIMEOUT:
+		return true
+	case ERROR:
+		if c, ok := b.(serverFailureClassifier); ok {
+			return c.isServerFailure(bf.Code)
+		}
+		return bf.Code >= 500
+	default:
+		return false
+	}
+}
+
+// isTransientFailure tells whether retrying the request which failed with err
+// may succeed: server failures which are typically temporary, timeouts and
+// throttling. HTTP based backends report failed connections as 500.
+func isTransientFailure(b Backend, err error) bool {
+	bf, ok := err.(*BackendFailure)
+	if !ok {
+		return true
+	}
+	if bf.class&failureClassified != 0 {
+		return bf.class&failureTransient != 0
+	}
+
+	if _, ok := b.(serverFailureClassifier); ok {
+		return isServerFailure(b, err)
+	}
+	switch b.ResolveProtocolCode(bf.Code) {
+	case TIMEOUT:
+		return true
+	case ERROR:
+		switch bf.Code {
+		case 429, 500, 502, 503, 504:
+			return true
+		}
+	}
+	return false
+}
+
+// wrappedFailure converts an error returned by the inner backend of a
+// wrapping backend into a BackendFailure whose code is already the
+// protocol status, see resolveStatusCode. Whether it is a server or a
+// transient failure is kept for the backends wrapping this one.
+func wrappedFailure(inner Backend, err error) *BackendFailure {
+	message := err.Error()
+	if bf, ok := err.(*BackendFailure); ok {
+		message = bf.Message
+	}
+
+	class := failureClassified
+	if isServerFailure(inner, err) {
+		class |= failureServer
+	}
+	if isTransientFailure(inner, err) {
+		class |= failureTransient
+	}
+	return &BackendFailure{
+		Message: message,
+		Code:    int(failureStatus(inner, err)),
+		class:   class}
+}
+
+// abandonedFailure wraps err like wrappedFailure when the request failed
+// because its ctx was canceled or ran out of time. Neither says anything
+// about the health of the server, so the failure is neither a server nor a
+// transient failure for the backends wrapping this one.
+func abandonedFailure(ctx context.Context, inner Backend, err error) *BackendFailure {
+	bf := wrappedFailure(inner, err)
+	if ctx.Err() != nil {
+		bf.class = failureClassified
+	}
+	return bf
+}
+
+// resolveStatusCode is the ResolveProtocolCode of wrapping backends, whose
+// failures carry protocol status codes.
+func resolveStatusCode(code int) StatusCode {
+	if code < LOCAL_ERR || code > ERROR {
+		return ERROR
+	}
+	return StatusCode(code)
 }
 
 // ParseAttributes reads a JSON configuration file and extracts attributes into a slice.
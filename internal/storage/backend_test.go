@@ -2,11 +2,13 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestHttpStorageBackend_Get(t *testing.T) {
@@ -22,7 +24,7 @@ func TestHttpStorageBackend_Get(t *testing.T) {
 	u, _ := url.Parse(server.URL)
 	backend := NewHTTPBackend(u, []Attribute{})
 
-	respBody, respLen, err := backend.Get([]byte{0x01, 0x02})
+	respBody, respLen, err := backend.Get(t.Context(), []byte{0x01, 0x02})
 	if err != nil {
 		t.Fatalf("Get() failed: %v", err)
 	}
@@ -42,3 +44,191 @@ func TestHttpStorageBackend_Get(t *testing.T) {
 		t.Error("Did not get correct data!")
 	}
 }
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"1500", 1500 * time.Millisecond},
+		{"0", 0},
+		{"", 0},
+		{"invalid", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseTimeout(tt.value); got != tt.want {
+			t.Errorf("parseTimeout(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBackendAttributes(t *testing.T) {
+	attributes := []Attribute{
+		{Key: "compression", Value: "zstd"},
+		{Key: "layout", Value: "flat"},
+		{Key: "write-behind", Value: "true"},
+		{Key: "retry-max-attempts", Value: "3"},
+	}
+
+	own := backendAttributes(attributes)
+	if len(own) != 1 || own[0].Key != "layout" {
+		t.Errorf("backendAttributes() = %v, want only the layout", own)
+	}
+}
+
+func TestHttpStorageBackend_OperationTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	u, _ := url.Parse(server.URL)
+	backend := NewHTTPBackend(u, []Attribute{{Key: "operation-timeout", Value: "50"}})
+
+	start := time.Now()
+	if _, _, err := backend.Get(t.Context(), []byte{0x01, 0x02}); err == nil {
+		t.Fatal("Get() from a hanging server should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Get() took %v despite an operation-timeout of 50ms", elapsed)
+	}
+}
+
+func TestHttpStorageBackend_ContextDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	u, _ := url.Parse(server.URL)
+	backend := NewHTTPBackend(u, []Attribute{})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	get := &GetMessage{key: []byte{0x01, 0x02}}
+	get.WriteToBackend(ctx, backend)
+	if status := get.ReadStatus(); status != TIMEOUT {
+		t.Errorf("Get() past the deadline reported %v, want TIMEOUT", status)
+	}
+}
+
+func TestHttpStorageBackend_PutUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	u, _ := url.Parse(server.URL)
+	server.Close()
+
+	backend := NewHTTPBackend(u, []Attribute{})
+	if _, err := backend.Put(t.Context(), []byte{0x01, 0x02}, []byte("object code"), true); err == nil {
+		t.Error("Put() to an unreachable server should fail")
+	}
+}
+
+func TestHttpStorageBackend_Stat(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("Stat() sent a %s request, want HEAD", r.Method)
+		}
+		if r.URL.Path != "/0102" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", "11")
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	backend := NewHTTPBackend(u, []Attribute{})
+
+	info, err := backend.Stat(t.Context(), []byte{0x01, 0x02})
+	if err != nil || info.Size != 11 || !info.LastModified.Equal(modified) {
+		t.Errorf("Stat() = %+v, %v, want 11 bytes modified at %v", info, err, modified)
+	}
+	if _, err := backend.Stat(t.Context(), []byte{0x03, 0x04}); err == nil {
+		t.Error("Stat() of a missing key should fail")
+	} else if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+		t.Errorf("Stat() miss resolved to %d, want NO_FILE", code)
+	}
+}
+
+func TestHttpStorageBackend_GetFailure(t *testing.T) {
+	tests := []struct {
+		status int
+		want   StatusCode
+	}{
+		{http.StatusNotFound, NO_FILE},
+		{http.StatusForbidden, ERROR},
+		{http.StatusInternalServerError, ERROR},
+	}
+
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte("error page"))
+		}))
+
+		u, _ := url.Parse(server.URL)
+		backend := NewHTTPBackend(u, []Attribute{})
+
+		body, _, err := backend.Get(t.Context(), []byte{0x01, 0x02})
+		if err == nil {
+			body.Close()
+			t.Errorf("Get() with status %d returned the response body", tt.status)
+		} else if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != tt.want {
+			t.Errorf("Get() with status %d resolved to %d, want %d", tt.status, code, tt.want)
+		}
+		server.Close()
+	}
+}
+
+func TestHttpStorageBackend_PutStream(t *testing.T) {
+	value := bytes.Repeat([]byte("object code "), 1000)
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != int64(len(value)) {
+			t.Errorf("Content-Length = %d, want %d", r.ContentLength, len(value))
+		}
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	backend := NewHTTPBackend(u, []Attribute{})
+
+	// Only the value is read, the data after it is left for the caller.
+	r := bytes.NewReader(append(bytes.Clone(value), "next message"...))
+	if ok, err := backend.PutStream(t.Context(), []byte{0x01, 0x02}, r, int64(len(value)), false); !ok || err != nil {
+		t.Fatalf("PutStream() = %v, %v", ok, err)
+	}
+	if !bytes.Equal(received, value) {
+		t.Errorf("server received %d bytes, want %d", len(received), len(value))
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "next message" {
+		t.Errorf("PutStream() read past the value, %q left", rest)
+	}
+}
+
+func TestPutBuffered(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	checksummed := NewChecksummedBackend(files, nil)
+
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+	if ok, err := checksummed.PutStream(t.Context(), key, bytes.NewReader(value), int64(len(value)), false); !ok || err != nil {
+		t.Fatalf("PutStream() = %v, %v", ok, err)
+	}
+	if data := readAll(t, checksummed, key); !bytes.Equal(data, value) {
+		t.Errorf("Get() = %q, want %q", data, value)
+	}
+
+	_, err := checksummed.PutStream(t.Context(), key, bytes.NewReader(value[:4]), int64(len(value)), false)
+	if err == nil || checksummed.ResolveProtocolCode(err.(*BackendFailure).Code) != LOCAL_ERR {
+		t.Errorf("PutStream() of a truncated value = %v, want LOCAL_ERR", err)
+	}
+}
@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"sync"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const batchDefaultConcurrency = 8
+
+// BatchResult is the outcome of one key of a batch.
+type BatchResult struct {
+	Value []byte // read by GetBatch
+	Done  bool   // returned by Put or Remove
+	Err   error
+}
+
+// BatchGetter is implemented by backends looking up several keys in one
+// round-trip, e.g. Redis with MGET, and by the layers wrapping a backend,
+// which pass the batch on to it. concurrency bounds the requests run at
+// once by backends without a native batch.
+type BatchGetter interface {
+	GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult
+}
+
+// batchConcurrency returns the number of requests of a batch run at once,
+// set by the "batch-concurrency" attribute (default 8).
+func batchConcurrency(attributes []Attribute) int {
+	value := findAttribute(attributes, "batch-concurrency")
+	if value == "" {
+		return batchDefaultConcurrency
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		LOG("Invalid batch-concurrency '%s', using %d", value, batchDefaultConcurrency)
+		return batchDefaultConcurrency
+	}
+	return n
+}
+
+// runBatch runs op for each of n keys, at most concurrency at once.
+func runBatch(n, concurrency int, op func(i int)) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for i := range n {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			op(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// GetBatch looks up keys in b, in one round-trip if b is a BatchGetter. The
+// values are read into memory.
+func GetBatch(ctx context.Context, b Backend, keys [][]byte, concurrency int) []BatchResult {
+	if getter, ok := b.(BatchGetter); ok {
+		return getter.GetBatch(ctx, keys, concurrency)
+	}
+
+	results := make([]BatchResult, len(keys))
+	runBatch(len(keys), concurrency, func(i int) {
+		body, _, err := b.Get(ctx, keys[i])
+		if err != nil {
+			results[i].Err = err
+			return
+		}
+		defer body.Close()
+		results[i].Value, results[i].Err = io.ReadAll(body)
+	})
+	return results
+}
+
+// getPending looks up the keys of the indices pending in inner with a
+// single batch. The results are in the order of pending.
+func getPending(ctx context.Context, inner Backend, keys [][]byte, pending []int, concurrency int) []BatchResult {
+	if len(pending) == 0 {
+		return nil
+	}
+	subset := make([][]byte, len(pending))
+	for j, i := range pending {
+		subset[j] = keys[i]
+	}
+	return GetBatch(ctx, inner, subset, concurrency)
+}
+
+// forwardBatch implements GetBatch for layers passing the values of inner
+// through unchanged. The failures are converted like by wrappedFailure.
+func forwardBatch(ctx context.Context, inner Backend, keys [][]byte, concurrency int) []BatchResult {
+	results := GetBatch(ctx, inner, keys, concurrency)
+	for i := range results {
+		if results[i].Err != nil {
+			results[i].Err = wrappedFailure(inner, results[i].Err)
+		}
+	}
+	return results
+}
+
+// decodeBatch implements GetBatch for layers transforming the values of
+// inner: each value found is passed through decode, which returns it as Get
+// of the layer does, and read into memory again.
+func decodeBatch(ctx context.Context, inner Backend, keys [][]byte, concurrency int,
+	decode func(key []byte, body io.ReadCloser, size int64) (io.ReadCloser, int64, error)) []BatchResult {
+	results := forwardBatch(ctx, inner, keys, concurrency)
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		object := results[i].Value
+		body, _, err := decode(keys[i], io.NopCloser(bytes.NewReader(object)), int64(len(object)))
+		if err != nil {
+			results[i] = BatchResult{Err: err}
+			continue
+		}
+		results[i].Value, results[i].Err = io.ReadAll(body)
+		body.Close()
+	}
+	return results
+}
+
+// PutBatch stores values[i] under keys[i] in b.
+func PutBatch(ctx context.Context, b Backend, keys, values [][]byte, onlyIfMissing bool, concurrency int) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	runBatch(len(keys), concurrency, func(i int) {
+		results[i].Done, results[i].Err = b.Put(ctx, keys[i], values[i], onlyIfMissing)
+	})
+	return results
+}
+
+// RemoveBatch removes keys from b.
+func RemoveBatch(ctx context.Context, b Backend, keys [][]byte, concurrency int) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	runBatch(len(keys), concurrency, func(i int) {
+		results[i].Done, results[i].Err = b.Remove(ctx, keys[i])
+	})
+	return results
+}
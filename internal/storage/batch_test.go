@@ -0,0 +1,41 @@
+package backend
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunBatch_Concurrency(t *testing.T) {
+	var running, peak atomic.Int32
+	done := make([]bool, 20)
+	runBatch(len(done), 3, func(i int) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		done[i] = true
+	})
+
+	if p := peak.Load(); p > 3 {
+		t.Errorf("%d operations ran at once, want at most 3", p)
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Errorf("operation %d didn't run", i)
+		}
+	}
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	for value, want := range map[string]int{"": 8, "4": 4, "0": 8, "many": 8} {
+		if n := batchConcurrency([]Attribute{{Key: "batch-concurrency", Value: value}}); n != want {
+			t.Errorf("batchConcurrency(%q) = %d, want %d", value, n, want)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	urlib "net/url"
+	"strings"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/google/uuid"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// bazelOutputPath names the single output file of the action result
+	// that references the cached value in the CAS.
+	bazelOutputPath = "ccache-entry"
+	// Blobs larger than this are transferred with ByteStream instead of
+	// the batch CAS calls, keeping messages below the default gRPC limit.
+	bazelMaxBatchSize = 1 << 20
+	bazelChunkSize    = 256 << 10
+)
+
+type BazelStorageBackend struct {
+	conn          *grpc.ClientConn
+	actionCache   repb.ActionCacheClient
+	cas           repb.ContentAddressableStorageClient
+	byteStream    bspb.ByteStreamClient
+	instanceName  string
+	authorization string
+	timeout       time.Duration
+}
+
+type bazelAttributes struct {
+	bearerToken      string
+	connectTimeout   time.Duration
+	operationTimeout time.Duration
+}
+
+// byteStreamReader exposes a ByteStream Read call as an io.ReadCloser.
+type byteStreamReader struct {
+	stream bspb.ByteStream_ReadClient
+	buf    []byte
+	cancel context.CancelFunc
+}
+
+func NewBazelAttributes() *bazelAttributes {
+	return &bazelAttributes{
+		connectTimeout:   10 * time.Second,
+		operationTimeout: 60 * time.Second,
+	}
+}
+
+// NewBazelBackend creates a Remote Execution API client for URLs of the form
+// [bazel+]grpc[s]://[USER:PASSWORD@]HOST:PORT[/INSTANCE_NAME].
+//
+// A ccache entry is stored as a blob in the ContentAddressableStorage which
+// is referenced by an ActionResult under the key's action digest.
+func NewBazelBackend(url *urlib.URL, attributes []Attribute) *BazelStorageBackend {
+	defaultAttrs := NewBazelAttributes()
+	for _, attr := range backendAttributes(attributes) {
+		switch attr.Key {
+		case "bearer-token":
+			defaultAttrs.bearerToken = attr.Value
+		case "connect-timeout":
+			defaultAttrs.connectTimeout = parseTimeout(attr.Value)
+		case "operation-timeout":
+			defaultAttrs.operationTimeout = parseTimeout(attr.Value)
+		default:
+			LOG("Bazel attribute '%s' not known!", attr.Key)
+		}
+	}
+
+	transportCreds := insecure.NewCredentials()
+	if strings.HasSuffix(url.Scheme, "grpcs") {
+		transportCreds = credentials.NewClientTLSFromCert(nil, "")
+	}
+
+	conn, err := grpc.NewClient(url.Host,
+		grpc.WithTransportCredentials(transportCreds),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: defaultAttrs.connectTimeout,
+		}))
+	if err != nil {
+		LOG("Error creating gRPC client: %v", err)
+		return nil
+	}
+
+	backend := &BazelStorageBackend{
+		conn:         conn,
+		actionCache:  repb.NewActionCacheClient(conn),
+		cas:          repb.NewContentAddressableStorageClient(conn),
+		byteStream:   bspb.NewByteStreamClient(conn),
+		instanceName: strings.Trim(url.Path, "/"),
+		timeout:      defaultAttrs.operationTimeout,
+	}
+
+	if defaultAttrs.bearerToken != "" {
+		backend.authorization = "Bearer " + defaultAttrs.bearerToken
+	} else if url.User != nil {
+		backend.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(url.User.String()))
+	}
+
+	return backend
+}
+
+// ResolveProtocolCode maps gRPC status codes onto the protocol status.
+// Negative codes are used for local failures.
+func (h *BazelStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	if code < 0 {
+		return LOCAL_ERR
+	}
+	switch codes.Code(code) {
+	case codes.OK:
+		return SUCCESS
+	case codes.NotFound:
+		return NO_FILE
+	case codes.DeadlineExceeded:
+		return TIMEOUT
+	default:
+		return ERROR
+	}
+}
+
+// isServerFailure tells whether the gRPC status code reports a failure of
+// the server or the connection to it, see isServerFailure.
+func (h *BazelStorageBackend) isServerFailure(code int) bool {
+	switch codes.Code(code) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown,
+		codes.ResourceExhausted, codes.Aborted, codes.Canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// newContext returns a context derived from ctx, bounded by the operation
+// timeout, which carries the authorization metadata, if any.
+func (h *BazelStorageBackend) newContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.authorization != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", h.authorization)
+	}
+	return context.WithTimeout(ctx, h.timeout)
+}
+
+// getActionDigest returns the digest of the action recording key, the
+// SHA256 hash of the key itself, so keys of any length map to a valid
+// digest.
+func (h *BazelStorageBackend) getActionDigest(key []byte) *repb.Digest {
+	sum := sha256.Sum256(key)
+	return &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(key))}
+}
+
+func (h *BazelStorageBackend) getResourceName(parts ...string) string {
+	if h.instanceName != "" {
+		parts = append([]string{h.instanceName}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+func findOutputFile(result *repb.ActionResult) *repb.OutputFile {
+	for _, file := range result.OutputFiles {
+		if file.Path == bazelOutputPath {
+			return file
+		}
+	}
+	return nil
+}
+
+// Get looks up the action result for key and fetches the referenced blob.
+//
+// Small blobs are returned inline or through BatchReadBlobs, larger ones are
+// streamed from ByteStream while the caller reads.
+func (h *BazelStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	actionDigest := h.getActionDigest(key)
+
+	ctx, cancel := h.newContext(ctx)
+	result, err := h.actionCache.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName:      h.instanceName,
+		ActionDigest:      actionDigest,
+		InlineOutputFiles: []string{bazelOutputPath},
+	})
+	if err != nil {
+		cancel()
+		return nil, 0, h.failure("get action result", actionDigest, err)
+	}
+
+	file := findOutputFile(result)
+	if file == nil || file.Digest == nil {
+		cancel()
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Action result %s has no %s output", actionDigest.Hash, bazelOutputPath),
+			Code:    int(codes.NotFound)}
+	}
+
+	size := file.Digest.SizeBytes
+	if int64(len(file.Contents)) == size {
+		cancel()
+		return io.NopCloser(bytes.NewReader(file.Contents)), size, nil
+	}
+
+	if size <= bazelMaxBatchSize {
+		defer cancel()
+		resp, err := h.cas.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+			InstanceName: h.instanceName,
+			Digests:      []*repb.Digest{file.Digest},
+		})
+		if err != nil {
+			return nil, 0, h.failure("read blob", file.Digest, err)
+		}
+		if len(resp.Responses) != 1 {
+			return nil, 0, &BackendFailure{
+				Message: fmt.Sprintf("Unexpected BatchReadBlobs response for %s", file.Digest.Hash),
+				Code:    int(codes.Internal)}
+		}
+		blob := resp.Responses[0]
+		if code := codes.Code(blob.GetStatus().GetCode()); code != codes.OK {
+			return nil, 0, h.failure("read blob", file.Digest, status.Error(code, blob.GetStatus().GetMessage()))
+		}
+		return io.NopCloser(bytes.NewReader(blob.Data)), size, nil
+	}
+
+	stream, err := h.byteStream.Read(ctx, &bspb.ReadRequest{
+		ResourceName: h.getResourceName("blobs", file.Digest.Hash, fmt.Sprint(size)),
+	})
+	if err != nil {
+		cancel()
+		return nil, 0, h.failure("read blob", file.Digest, err)
+	}
+
+	return &byteStreamReader{stream: stream, cancel: cancel}, size, nil
+}
+
+// Put uploads data to the CAS, unless it is already present, and records an
+// action result for key referencing it.
+//
+// When onlyIfMissing is set an existing action result whose blob is still
+// in the CAS (checked with FindMissingBlobs) results in (false, nil).
+func (h *BazelStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	actionDigest := h.getActionDigest(key)
+
+	sum := sha256.Sum256(data)
+	blobDigest := &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+
+	ctx, cancel := h.newContext(ctx)
+	defer cancel()
+
+	if onlyIfMissing {
+		result, err := h.actionCache.GetActionResult(ctx, &repb.GetActionResultRequest{
+			InstanceName: h.instanceName,
+			ActionDigest: actionDigest,
+		})
+		if err == nil {
+			if file := findOutputFile(result); file != nil && file.Digest != nil {
+				missing, err := h.findMissing(ctx, file.Digest)
+				if err != nil {
+					return false, h.failure("find missing blobs", file.Digest, err)
+				}
+				if !missing {
+					return false, nil // entry was found, no need to put again
+				}
+			}
+		} else if status.Code(err) != codes.NotFound {
+			return false, h.failure("get action result", actionDigest, err)
+		}
+	}
+
+	missing, err := h.findMissing(ctx, blobDigest)
+	if err != nil {
+		return false, h.failure("find missing blobs", blobDigest, err)
+	}
+	if missing {
+		if err := h.uploadBlob(ctx, blobDigest, data); err != nil {
+			return false, h.failure("upload blob", blobDigest, err)
+		}
+	}
+
+	_, err = h.actionCache.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: h.instanceName,
+		ActionDigest: actionDigest,
+		ActionResult: &repb.ActionResult{
+			OutputFiles: []*repb.OutputFile{{Path: bazelOutputPath, Digest: blobDigest}},
+		},
+	})
+	if err != nil {
+		return false, h.failure("update action result", actionDigest, err)
+	}
+
+	return true, nil
+}
+
+// PutStream reads the value into memory, as its digest is needed before it
+// is uploaded.
+func (h *BazelStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	data, err := readValue(r, size)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to read value of %x: %v", key, err),
+			Code:    -1}
+	}
+	return h.Put(ctx, key, data, onlyIfMissing)
+}
+
+// Stat looks the action result and its blob up with Get.
+func (h *BazelStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	return statByGet(ctx, h, key)
+}
+
+// Remove is not supported, the Remote Execution API has no way to delete
+// entries from the action cache.
+func (h *BazelStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	return false, &BackendFailure{
+		Message: "Remote Execution API does not support removing entries",
+		Code:    int(codes.Unimplemented)}
+}
+
+// findMissing reports whether the CAS lacks the blob with the given digest.
+func (h *BazelStorageBackend) findMissing(ctx context.Context, digest *repb.Digest) (bool, error) {
+	resp, err := h.cas.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		InstanceName: h.instanceName,
+		BlobDigests:  []*repb.Digest{digest},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.MissingBlobDigests) != 0, nil
+}
+
+// uploadBlob writes data to the CAS, through ByteStream for large blobs.
+func (h *BazelStorageBackend) uploadBlob(ctx context.Context, digest *repb.Digest, data []byte) error {
+	if digest.SizeBytes <= bazelMaxBatchSize {
+		resp, err := h.cas.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+			InstanceName: h.instanceName,
+			Requests:     []*repb.BatchUpdateBlobsRequest_Request{{Digest: digest, Data: data}},
+		})
+		if err != nil {
+			return err
+		}
+		for _, blob := range resp.Responses {
+			if code := codes.Code(blob.GetStatus().GetCode()); code != codes.OK {
+				return status.Error(code, blob.GetStatus().GetMessage())
+			}
+		}
+		return nil
+	}
+
+	stream, err := h.byteStream.Write(ctx)
+	if err != nil {
+		return err
+	}
+
+	resourceName := h.getResourceName("uploads", uuid.NewString(), "blobs", digest.Hash, fmt.Sprint(digest.SizeBytes))
+	for offset := 0; offset < len(data); offset += bazelChunkSize {
+		end := min(offset+bazelChunkSize, len(data))
+		req := &bspb.WriteRequest{
+			WriteOffset: int64(offset),
+			FinishWrite: end == len(data),
+			Data:        data[offset:end],
+		}
+		// The resource name is only required on the first request.
+		if offset == 0 {
+			req.ResourceName = resourceName
+		}
+		if err := stream.Send(req); err != nil {
+			if err == io.EOF {
+				// The server may end the stream early if it already has the blob.
+				break
+			}
+			return err
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if resp.CommittedSize != digest.SizeBytes {
+		return fmt.Errorf("committed %d of %d bytes", resp.CommittedSize, digest.SizeBytes)
+	}
+	return nil
+}
+
+// failure wraps a gRPC error into a BackendFailure carrying its status code.
+func (h *BazelStorageBackend) failure(op string, digest *repb.Digest, err error) *BackendFailure {
+	return &BackendFailure{
+		Message: fmt.Sprintf("Failed to %s %s/%d: %v", op, digest.Hash, digest.SizeBytes, err),
+		Code:    int(status.Code(err))}
+}
+
+func (r *byteStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		resp, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = resp.Data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *byteStreamReader) Close() error {
+	r.cancel()
+	return nil
+}
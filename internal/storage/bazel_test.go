@@ -0,0 +1,217 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeREAPI is an in-memory ActionCache, CAS and ByteStream server.
+type fakeREAPI struct {
+	repb.UnimplementedActionCacheServer
+	repb.UnimplementedContentAddressableStorageServer
+	bspb.UnimplementedByteStreamServer
+
+	mu          sync.Mutex
+	actions     map[string]*repb.ActionResult
+	blobs       map[string][]byte
+	streamReads int
+}
+
+func newFakeREAPI(t *testing.T) (*fakeREAPI, *url.URL) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	fake := &fakeREAPI{actions: make(map[string]*repb.ActionResult), blobs: make(map[string][]byte)}
+	server := grpc.NewServer()
+	repb.RegisterActionCacheServer(server, fake)
+	repb.RegisterContentAddressableStorageServer(server, fake)
+	bspb.RegisterByteStreamServer(server, fake)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	u, _ := url.Parse("grpc://" + l.Addr().String() + "/main")
+	return fake, u
+}
+
+func (f *fakeREAPI) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result, ok := f.actions[req.InstanceName+"/"+req.ActionDigest.Hash]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no such action")
+	}
+	return result, nil
+}
+
+func (f *fakeREAPI) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.actions[req.InstanceName+"/"+req.ActionDigest.Hash] = req.ActionResult
+	return req.ActionResult, nil
+}
+
+func (f *fakeREAPI) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.FindMissingBlobsResponse{}
+	for _, digest := range req.BlobDigests {
+		if _, ok := f.blobs[digest.Hash]; !ok {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, digest)
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeREAPI) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.BatchUpdateBlobsResponse{}
+	for _, r := range req.Requests {
+		f.blobs[r.Digest.Hash] = r.Data
+		resp.Responses = append(resp.Responses, &repb.BatchUpdateBlobsResponse_Response{
+			Digest: r.Digest, Status: &rpcstatus.Status{}})
+	}
+	return resp, nil
+}
+
+func (f *fakeREAPI) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.BatchReadBlobsResponse{}
+	for _, digest := range req.Digests {
+		data, ok := f.blobs[digest.Hash]
+		code := codes.OK
+		if !ok {
+			code = codes.NotFound
+		}
+		resp.Responses = append(resp.Responses, &repb.BatchReadBlobsResponse_Response{
+			Digest: digest, Data: data, Status: &rpcstatus.Status{Code: int32(code)}})
+	}
+	return resp, nil
+}
+
+func (f *fakeREAPI) Read(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	parts := strings.Split(req.ResourceName, "/")
+	f.mu.Lock()
+	data, ok := f.blobs[parts[len(parts)-2]]
+	f.streamReads++
+	f.mu.Unlock()
+	if !ok {
+		return status.Error(codes.NotFound, "no such blob")
+	}
+
+	for len(data) > 0 {
+		n := min(len(data), 64<<10)
+		if err := stream.Send(&bspb.ReadResponse{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (f *fakeREAPI) Write(stream bspb.ByteStream_WriteServer) error {
+	var resourceName string
+	var data []byte
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if req.ResourceName != "" {
+			resourceName = req.ResourceName
+		}
+		data = append(data, req.Data...)
+		if req.FinishWrite {
+			break
+		}
+	}
+
+	parts := strings.Split(resourceName, "/")
+	f.mu.Lock()
+	f.blobs[parts[len(parts)-2]] = data
+	f.mu.Unlock()
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(len(data))})
+}
+
+func TestBazelStorageBackend_PutGet(t *testing.T) {
+	fake, u := newFakeREAPI(t)
+	backend := NewBazelBackend(u, nil)
+
+	tests := []struct {
+		name  string
+		key   []byte
+		value []byte
+	}{
+		{"small blob", bytes.Repeat([]byte{0x01}, 20), []byte("small value")},
+		{"bytestream blob", bytes.Repeat([]byte{0x02}, 20), bytes.Repeat([]byte("large"), bazelMaxBatchSize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := backend.Get(t.Context(), tt.key); err == nil {
+				t.Fatal("Get() on empty cache should fail")
+			} else if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+				t.Errorf("Get() miss resolved to %d, want NO_FILE", code)
+			}
+
+			if ok, err := backend.Put(t.Context(), tt.key, tt.value, true); !ok || err != nil {
+				t.Fatalf("Put() = %v, %v", ok, err)
+			}
+			if ok, err := backend.Put(t.Context(), tt.key, []byte("other"), true); ok || err != nil {
+				t.Errorf("Put() with onlyIfMissing on existing key = %v, %v", ok, err)
+			}
+
+			body, size, err := backend.Get(t.Context(), tt.key)
+			if err != nil {
+				t.Fatalf("Get() failed: %v", err)
+			}
+			data, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || !bytes.Equal(data, tt.value) || size != int64(len(tt.value)) {
+				t.Errorf("Get() returned %d bytes (size %d, err %v), want %d", len(data), size, err, len(tt.value))
+			}
+		})
+	}
+
+	if fake.streamReads != 1 {
+		t.Errorf("expected exactly one ByteStream read, got %d", fake.streamReads)
+	}
+
+	if _, err := backend.Remove(t.Context(), tests[0].key); err == nil {
+		t.Error("Remove() should not be supported")
+	}
+}
+
+func TestBazelStorageBackend_KeyLength(t *testing.T) {
+	_, u := newFakeREAPI(t)
+	backend := NewBazelBackend(u, nil)
+
+	// Keys sharing a prefix, of lengths other than the 20 bytes of ccache.
+	short, long := []byte{0x01, 0x02}, append(bytes.Repeat([]byte{0x01}, 32), 0x02)
+	for _, key := range [][]byte{short, long, long[:32]} {
+		if ok, err := backend.Put(t.Context(), key, key, false); !ok || err != nil {
+			t.Fatalf("Put() of a %d byte key = %v, %v", len(key), ok, err)
+		}
+	}
+	for _, key := range [][]byte{short, long, long[:32]} {
+		if data := readAll(t, backend, key); !bytes.Equal(data, key) {
+			t.Errorf("Get() of a %d byte key = %x, want %x", len(key), data, key)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const (
+	breakerDefaultThreshold = 5
+	breakerDefaultCoolDown  = 30 * time.Second
+)
+
+// CircuitState is the state of a CircuitBreakerBackend.
+type CircuitState int
+
+const (
+	// CircuitClosed passes every request to the wrapped backend.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails every request without contacting the backend.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitBreakerBackend stops contacting a backend failing repeatedly with
+// server failures (see isServerFailure). While the circuit is open, Get
+// reports a miss and Put and Remove fail with LOCAL_ERR at once, so ccache
+// goes on compiling instead of waiting for timeouts.
+type CircuitBreakerBackend struct {
+	inner     Backend
+	threshold int
+	coolDown  time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreakerBackend wraps inner with a circuit breaker. The circuit
+// opens after "breaker-failure-threshold" consecutive server failures
+// (default 5). After "breaker-cool-down" milliseconds (default 30000) it
+// half-opens: one probe request is passed on, closing the circuit if it
+// succeeds and opening it again otherwise.
+func NewCircuitBreakerBackend(inner Backend, attributes []Attribute) *CircuitBreakerBackend {
+	h := &CircuitBreakerBackend{
+		inner:     inner,
+		threshold: breakerDefaultThreshold,
+		coolDown:  breakerDefaultCoolDown,
+	}
+
+	if value := findAttribute(attributes, "breaker-failure-threshold"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			LOG("Invalid breaker-failure-threshold '%s', using %d", value, h.threshold)
+		} else {
+			h.threshold = n
+		}
+	}
+	if value := findAttribute(attributes, "breaker-cool-down"); value != "" {
+		h.coolDown = parseTimeout(value)
+	}
+	return h
+}
+
+// State returns the current state of the circuit.
+func (h *CircuitBreakerBackend) State() CircuitState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state == CircuitOpen && time.Since(h.openedAt) >= h.coolDown {
+		return CircuitHalfOpen
+	}
+	return h.state
+}
+
+func (h *CircuitBreakerBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// transition changes the state of the circuit. Must be called with mu held.
+func (h *CircuitBreakerBackend) transition(state CircuitState) {
+	LOG("Circuit breaker %v -> %v (%d consecutive failures)", h.state, state, h.failures)
+	h.state = state
+	if state == CircuitOpen {
+		h.openedAt = time.Now()
+	}
+}
+
+// allow tells whether a request may be passed to the wrapped backend. Once
+// the cool-down elapsed, the first request becomes the probe; the others
+// are rejected until it completes.
+func (h *CircuitBreakerBackend) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch h.state {
+	case CircuitClosed:
+		return true
+	case CircuitOpen:
+		if time.Since(h.openedAt) >= h.coolDown {
+			h.transition(CircuitHalfOpen)
+			return true
+		}
+	}
+	return false
+}
+
+// report records the outcome of a request passed to the wrapped backend.
+// Only server failures count, a miss or a rejected request show the
+// backend is reachable. A request abandoned by its caller counts neither
+// way; if it was the probe, the next request probes again.
+func (h *CircuitBreakerBackend) report(ctx context.Context, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil && ctx.Err() != nil {
+		if h.state == CircuitHalfOpen {
+			// openedAt is kept, so the cool-down has already elapsed
+			h.state = CircuitOpen
+		}
+		return
+	}
+	if err == nil || !isServerFailure(h.inner, err) {
+		if h.state != CircuitClosed {
+			h.transition(CircuitClosed)
+		}
+		h.failures = 0
+		return
+	}
+
+	h.failures++
+	if h.state == CircuitHalfOpen || (h.state == CircuitClosed && h.failures >= h.threshold) {
+		h.transition(CircuitOpen)
+	}
+}
+
+// rejected returns the failure of a request short-circuited with code. It
+// counts as a server failure, so a combining backend fails over.
+func (h *CircuitBreakerBackend) rejected(key []byte, code StatusCode) *BackendFailure {
+	LOG("Circuit breaker is %v, not contacting the backend for %x", h.State(), key)
+	return &BackendFailure{
+		Message: "Circuit breaker is open",
+		Code:    int(code),
+		class:   failureClassified | failureServer}
+}
+
+func (h *CircuitBreakerBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	if !h.allow() {
+		return nil, 0, h.rejected(key, NO_FILE)
+	}
+	body, size, err := h.inner.Get(ctx, key)
+	h.report(ctx, err)
+	if err != nil {
+		return nil, 0, abandonedFailure(ctx, h.inner, err)
+	}
+	return body, size, nil
+}
+
+// GetBatch passes the batch on as a single request, which fails if one of
+// its keys failed with a server failure.
+func (h *CircuitBreakerBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	if !h.allow() {
+		results := make([]BatchResult, len(keys))
+		for i, key := range keys {
+			results[i].Err = h.rejected(key, NO_FILE)
+		}
+		return results
+	}
+
+	results := GetBatch(ctx, h.inner, keys, concurrency)
+	var err error
+	for _, result := range results {
+		if result.Err != nil && isServerFailure(h.inner, result.Err) {
+			err = result.Err
+			break
+		}
+	}
+	h.report(ctx, err)
+
+	for i := range results {
+		if results[i].Err != nil {
+			results[i].Err = abandonedFailure(ctx, h.inner, results[i].Err)
+		}
+	}
+	return results
+}
+
+func (h *CircuitBreakerBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	if !h.allow() {
+		return false, h.rejected(key, LOCAL_ERR)
+	}
+	ok, err := h.inner.Put(ctx, key, data, onlyIfMissing)
+	h.report(ctx, err)
+	if err != nil {
+		return false, abandonedFailure(ctx, h.inner, err)
+	}
+	return ok, nil
+}
+
+func (h *CircuitBreakerBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	if !h.allow() {
+		return false, h.rejected(key, LOCAL_ERR)
+	}
+	ok, err := h.inner.PutStream(ctx, key, r, size, onlyIfMissing)
+	h.report(ctx, err)
+	if err != nil {
+		return false, abandonedFailure(ctx, h.inner, err)
+	}
+	return ok, nil
+}
+
+func (h *CircuitBreakerBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	if !h.allow() {
+		return false, h.rejected(key, LOCAL_ERR)
+	}
+	ok, err := h.inner.Remove(ctx, key)
+	h.report(ctx, err)
+	if err != nil {
+		return false, abandonedFailure(ctx, h.inner, err)
+	}
+	return ok, nil
+}
+
+// Stat reports a missing key while the circuit is open, like Get.
+func (h *CircuitBreakerBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	if !h.allow() {
+		return ObjectInfo{}, h.rejected(key, NO_FILE)
+	}
+	info, err := h.inner.Stat(ctx, key)
+	h.report(ctx, err)
+	if err != nil {
+		return ObjectInfo{}, abandonedFailure(ctx, h.inner, err)
+	}
+	return info, nil
+}
+
+func (h *CircuitBreakerBackend) Drain() {
+	drain(h.inner)
+}
@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerBackend(t *testing.T) {
+	inner := &flakyBackend{Backend: NewFileBackend(&url.URL{Path: t.TempDir()}, nil), failures: 3}
+	breaker := NewCircuitBreakerBackend(inner, []Attribute{
+		{Key: "breaker-failure-threshold", Value: "3"},
+		{Key: "breaker-cool-down", Value: "50"},
+	})
+
+	key := []byte{0x01, 0x02, 0x03}
+	for range 3 {
+		if breaker.State() != CircuitClosed {
+			t.Fatalf("State() = %v before the threshold, want closed", breaker.State())
+		}
+		breaker.Get(t.Context(), key)
+	}
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("State() = %v after 3 failures, want open", breaker.State())
+	}
+
+	_, _, err := breaker.Get(t.Context(), key)
+	if code := breaker.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+		t.Errorf("Get() with an open circuit resolved to %d, want NO_FILE", code)
+	}
+	ok, err := breaker.Put(t.Context(), key, []byte("object code"), false)
+	if ok || err == nil || breaker.ResolveProtocolCode(err.(*BackendFailure).Code) != LOCAL_ERR {
+		t.Errorf("Put() with an open circuit = %v, %v, want LOCAL_ERR", ok, err)
+	}
+	if inner.calls != 3 {
+		t.Errorf("open circuit passed requests on, %d calls", inner.calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if breaker.State() != CircuitHalfOpen {
+		t.Fatalf("State() = %v after the cool-down, want half-open", breaker.State())
+	}
+	if ok, err := breaker.Put(t.Context(), key, []byte("object code"), false); !ok || err != nil {
+		t.Fatalf("probe Put() = %v, %v", ok, err)
+	}
+	if breaker.State() != CircuitClosed {
+		t.Errorf("State() = %v after a successful probe, want closed", breaker.State())
+	}
+	if _, _, err := breaker.Get(t.Context(), key); err != nil {
+		t.Errorf("Get() with a closed circuit failed: %v", err)
+	}
+}
+
+func TestCircuitBreakerBackend_FailedProbe(t *testing.T) {
+	down := &downBackend{}
+	breaker := NewCircuitBreakerBackend(down, []Attribute{
+		{Key: "breaker-failure-threshold", Value: "1"},
+		{Key: "breaker-cool-down", Value: "20"},
+	})
+
+	key := []byte{0x01, 0x02, 0x03}
+	breaker.Remove(t.Context(), key)
+	time.Sleep(30 * time.Millisecond)
+	breaker.Remove(t.Context(), key)
+	if breaker.State() != CircuitOpen {
+		t.Errorf("State() = %v after a failed probe, want open", breaker.State())
+	}
+	breaker.Remove(t.Context(), key)
+	if down.calls != 2 {
+		t.Errorf("%d calls, want the first request and the probe only", down.calls)
+	}
+}
+
+func TestCircuitBreakerBackend_Misses(t *testing.T) {
+	breaker := NewCircuitBreakerBackend(NewFileBackend(&url.URL{Path: t.TempDir()}, nil),
+		[]Attribute{{Key: "breaker-failure-threshold", Value: "1"}})
+
+	for range 3 {
+		breaker.Get(t.Context(), []byte{0x01, 0x02, 0x03})
+	}
+	if breaker.State() != CircuitClosed {
+		t.Errorf("State() = %v after misses, want closed", breaker.State())
+	}
+}
+
+func TestCircuitBreakerBackend_Abandoned(t *testing.T) {
+	up := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	breaker := NewCircuitBreakerBackend(&stuckBackend{up},
+		[]Attribute{{Key: "breaker-failure-threshold", Value: "1"}})
+
+	key := []byte{0x01, 0x02, 0x03}
+	for range 3 {
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+		_, err := breaker.Put(ctx, key, []byte("object code"), false)
+		cancel()
+		if err == nil {
+			t.Fatal("Put() past the deadline succeeded")
+		}
+		if isServerFailure(breaker, err) {
+			t.Errorf("Put() past the deadline reported a server failure: %v", err)
+		}
+	}
+	if breaker.State() != CircuitClosed {
+		t.Errorf("State() = %v after requests ran out of time, want closed", breaker.State())
+	}
+}
@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"sync"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const budgetDefaultWait = 10 * time.Second
+
+// MemoryBudget limits the memory held by the requests of all connections
+// together. A nil budget admits everything.
+type MemoryBudget struct {
+	limit int64
+	wait  time.Duration
+
+	mu      sync.Mutex
+	used    int64
+	changed chan struct{} // closed whenever memory is released
+}
+
+// NewMemoryBudget returns the budget set by the "memory-budget" attribute,
+// or nil if there is none. A request over the budget waits at most
+// "memory-budget-wait" milliseconds (default 10000) for memory to be
+// released, 0 fails it at once.
+func NewMemoryBudget(attributes []Attribute) *MemoryBudget {
+	value := findAttribute(attributes, "memory-budget")
+	if value == "" {
+		return nil
+	}
+	limit, err := parseSize(value)
+	if err != nil || limit <= 0 {
+		LOG("Invalid memory-budget '%s', memory is not limited", value)
+		return nil
+	}
+
+	b := &MemoryBudget{limit: limit, wait: budgetDefaultWait, changed: make(chan struct{})}
+	if value := findAttribute(attributes, "memory-budget-wait"); value != "" {
+		b.wait = parseTimeout(value)
+	}
+	return b
+}
+
+// Acquire reserves n bytes, waiting for them to be released by other
+// requests if needed. A request larger than the whole budget is admitted
+// when it is the only one. It returns false if the bytes couldn't be
+// reserved in time; nothing is reserved then.
+func (b *MemoryBudget) Acquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	deadline := time.NewTimer(b.wait)
+	defer deadline.Stop()
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit || b.used == 0 {
+			b.used += n
+			b.mu.Unlock()
+			return true
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			LOG("Memory budget of %d bytes exhausted, rejecting a request of %d bytes", b.limit, n)
+			return false
+		}
+	}
+}
+
+// TryAcquire reserves n bytes if they are available right away, like
+// Acquire without waiting for other requests.
+func (b *MemoryBudget) TryAcquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n <= b.limit || b.used == 0 {
+		b.used += n
+		return true
+	}
+	return false
+}
+
+// Release returns n bytes reserved by Acquire or TryAcquire.
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Used returns the number of bytes reserved.
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget([]Attribute{{Key: "memory-budget", Value: "100"}})
+
+	if !budget.Acquire(60) {
+		t.Fatal("Acquire() within the budget should succeed")
+	}
+	done := make(chan bool)
+	go func() { done <- budget.Acquire(60) }()
+	select {
+	case <-done:
+		t.Fatal("Acquire() over the budget should wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.Release(60)
+	if !<-done {
+		t.Error("Acquire() should succeed once memory is released")
+	}
+	if used := budget.Used(); used != 60 {
+		t.Errorf("Used() = %d, want 60", used)
+	}
+}
+
+func TestMemoryBudget_Reject(t *testing.T) {
+	budget := NewMemoryBudget([]Attribute{
+		{Key: "memory-budget", Value: "100"},
+		{Key: "memory-budget-wait", Value: "0"},
+	})
+
+	// A request larger than the budget is admitted alone.
+	if !budget.Acquire(200) {
+		t.Fatal("Acquire() of an oversized request should succeed when alone")
+	}
+	if budget.Acquire(1) {
+		t.Error("Acquire() over the budget should fail")
+	}
+	budget.Release(200)
+	if used := budget.Used(); used != 0 {
+		t.Errorf("Used() = %d after a rejection, want 0", used)
+	}
+}
+
+func TestMemoryBudget_Unlimited(t *testing.T) {
+	budget := NewMemoryBudget(nil)
+	if budget != nil {
+		t.Fatal("NewMemoryBudget() without memory-budget should return nil")
+	}
+	if !budget.Acquire(1 << 40) {
+		t.Error("Acquire() on a nil budget should succeed")
+	}
+	budget.Release(1 << 40)
+}
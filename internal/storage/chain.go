@@ -0,0 +1,237 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+// ChainedStorageBackend combines an ordered list of backends. Lookups try
+// each backend in turn until one hits, writes go to a configurable subset.
+type ChainedStorageBackend struct {
+	nodes    []Backend
+	writable []bool
+	promote  bool
+}
+
+// CombineBackends builds a single backend from the backends of several
+// remote URLs, given in the order they were configured.
+//
+// The "remote-mode" attribute selects how they are combined: "chain"
+// (default) tries them in order, "shard" distributes the keys over them and
+// "replicate" stores every entry on all of them.
+func CombineBackends(urls []string, nodes []Backend, attributes []Attribute) Backend {
+	switch mode := findAttribute(attributes, "remote-mode"); mode {
+	case "", "chain":
+		return NewChainedBackend(nodes, attributes)
+	case "shard":
+		return NewShardedBackend(urls, nodes, attributes)
+	case "replicate":
+		return NewReplicatedBackend(urls, nodes, attributes)
+	default:
+		LOG("Remote mode '%s' not known, chaining backends", mode)
+		return NewChainedBackend(nodes, attributes)
+	}
+}
+
+// NewChainedBackend creates a backend trying nodes in order.
+//
+// The "write-to" attribute selects the nodes receiving writes: "all"
+// (default), "primary" or a comma separated list of 1-based positions.
+// With "promote-on-hit" set to true, entries found in a later node are
+// copied into the nodes before it.
+func NewChainedBackend(nodes []Backend, attributes []Attribute) *ChainedStorageBackend {
+	h := &ChainedStorageBackend{
+		nodes:    nodes,
+		writable: make([]bool, len(nodes)),
+	}
+
+	writeTo := findAttribute(attributes, "write-to")
+	if err := h.setWritable(writeTo); err != nil {
+		LOG("Invalid write-to '%s', writing to all backends: %v", writeTo, err)
+		h.setWritable("all")
+	}
+	h.promote = findAttribute(attributes, "promote-on-hit") == "true"
+
+	return h
+}
+
+func (h *ChainedStorageBackend) setWritable(writeTo string) error {
+	for i := range h.writable {
+		h.writable[i] = false
+	}
+
+	switch writeTo {
+	case "", "all":
+		for i := range h.writable {
+			h.writable[i] = true
+		}
+	case "primary":
+		h.writable[0] = true
+	default:
+		for _, field := range strings.Split(writeTo, ",") {
+			position, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || position < 1 || position > len(h.nodes) {
+				return fmt.Errorf("no backend at position '%s'", field)
+			}
+			h.writable[position-1] = true
+		}
+	}
+	return nil
+}
+
+func (h *ChainedStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// Get returns the entry from the first node holding it. The result is a
+// miss only if every node missed, otherwise the first real failure is
+// reported.
+func (h *ChainedStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	var failure *BackendFailure
+	for i, node := range h.nodes {
+		body, size, err := node.Get(ctx, key)
+		if err == nil {
+			if h.promote && i > 0 {
+				return h.promoteEntry(ctx, key, i, body)
+			}
+			return body, size, nil
+		}
+
+		bf := wrappedFailure(node, err)
+		if bf.Code != NO_FILE {
+			LOG("Backend %d failed, trying next: %v", i, err)
+			if failure == nil {
+				failure = bf
+			}
+		}
+	}
+
+	if failure != nil {
+		return nil, 0, failure
+	}
+	return nil, 0, &BackendFailure{
+		Message: fmt.Sprintf("No backend holds %x", key),
+		Code:    NO_FILE}
+}
+
+// promoteEntry copies the entry read from the node at index found into all
+// nodes before it and returns the buffered entry.
+func (h *ChainedStorageBackend) promoteEntry(ctx context.Context, key []byte, found int, body io.ReadCloser) (io.ReadCloser, int64, error) {
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Failed to read %x from backend %d: %v", key, found, err),
+			Code:    ERROR}
+	}
+
+	for i := range found {
+		if _, err := h.nodes[i].Put(ctx, key, data, false); err != nil {
+			LOG("Failed to promote %x to backend %d: %v", key, i, err)
+		}
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// Put writes data to all writable nodes. It only fails if none of them
+// accepted the write, failures of single nodes are logged.
+func (h *ChainedStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	var failure *BackendFailure
+	stored, succeeded := false, false
+	for i, node := range h.nodes {
+		if !h.writable[i] {
+			continue
+		}
+
+		ok, err := node.Put(ctx, key, data, onlyIfMissing)
+		if err != nil {
+			LOG("Failed to write %x to backend %d: %v", key, i, err)
+			if failure == nil {
+				failure = wrappedFailure(node, err)
+			}
+			continue
+		}
+		stored = stored || ok
+		succeeded = true
+	}
+
+	if !succeeded && failure != nil {
+		return false, failure
+	}
+	return stored, nil
+}
+
+// PutStream reads the value into memory, as it may be written to
+// several backends.
+func (h *ChainedStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Remove deletes key from every node, so no stale copy remains reachable
+// through a later node.
+func (h *ChainedStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	var failure *BackendFailure
+	removed := false
+	for i, node := range h.nodes {
+		ok, err := node.Remove(ctx, key)
+		if err != nil {
+			bf := wrappedFailure(node, err)
+			if bf.Code != NO_FILE && failure == nil {
+				LOG("Failed to remove %x from backend %d: %v", key, i, err)
+				failure = bf
+			}
+			continue
+		}
+		removed = removed || ok
+	}
+
+	if removed {
+		return true, nil
+	}
+	if failure != nil {
+		return false, failure
+	}
+	return false, &BackendFailure{
+		Message: fmt.Sprintf("No backend holds %x", key),
+		Code:    NO_FILE}
+}
+
+// Stat describes the entry of the first node holding it, failures are
+// reported like by Get.
+func (h *ChainedStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	var failure *BackendFailure
+	for i, node := range h.nodes {
+		info, err := node.Stat(ctx, key)
+		if err == nil {
+			return info, nil
+		}
+
+		bf := wrappedFailure(node, err)
+		if bf.Code != NO_FILE {
+			LOG("Backend %d failed, trying next: %v", i, err)
+			if failure == nil {
+				failure = bf
+			}
+		}
+	}
+
+	if failure != nil {
+		return ObjectInfo{}, failure
+	}
+	return ObjectInfo{}, &BackendFailure{
+		Message: fmt.Sprintf("No backend holds %x", key),
+		Code:    NO_FILE}
+}
+
+func (h *ChainedStorageBackend) Drain() {
+	for _, node := range h.nodes {
+		drain(node)
+	}
+}
@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"net/url"
+	"testing"
+)
+
+func newChainTestNodes(t *testing.T, n int) []Backend {
+	nodes := make([]Backend, n)
+	for i := range nodes {
+		nodes[i] = NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	}
+	return nodes
+}
+
+func TestChainedStorageBackend_Get(t *testing.T) {
+	key := []byte{0x01, 0x02, 0x03}
+
+	tests := []struct {
+		name     string
+		promote  string
+		promoted bool
+	}{
+		{"without promotion", "false", false},
+		{"with promotion", "true", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := newChainTestNodes(t, 2)
+			chain := NewChainedBackend(nodes, []Attribute{{Key: "promote-on-hit", Value: tt.promote}})
+
+			if _, _, err := chain.Get(t.Context(), key); err == nil {
+				t.Fatal("Get() on empty chain should fail")
+			} else if code := chain.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+				t.Errorf("Get() miss resolved to %d, want NO_FILE", code)
+			}
+
+			nodes[1].Put(t.Context(), key, []byte("value"), false)
+			if data := readAll(t, chain, key); string(data) != "value" {
+				t.Errorf("Get() = %q, want \"value\"", data)
+			}
+
+			_, _, err := nodes[0].Get(t.Context(), key)
+			if promoted := err == nil; promoted != tt.promoted {
+				t.Errorf("entry promoted to primary = %v, want %v", promoted, tt.promoted)
+			}
+		})
+	}
+}
+
+func TestChainedStorageBackend_Put(t *testing.T) {
+	key := []byte{0x01, 0x02, 0x03}
+
+	tests := []struct {
+		writeTo string
+		want    []bool
+	}{
+		{"", []bool{true, true, true}},
+		{"all", []bool{true, true, true}},
+		{"primary", []bool{true, false, false}},
+		{"1,3", []bool{true, false, true}},
+		{"4", []bool{true, true, true}},
+	}
+
+	for _, tt := range tests {
+		nodes := newChainTestNodes(t, 3)
+		chain := NewChainedBackend(nodes, []Attribute{{Key: "write-to", Value: tt.writeTo}})
+
+		if ok, err := chain.Put(t.Context(), key, []byte("value"), false); !ok || err != nil {
+			t.Fatalf("Put() with write-to '%s' = %v, %v", tt.writeTo, ok, err)
+		}
+		for i, node := range nodes {
+			if _, _, err := node.Get(t.Context(), key); (err == nil) != tt.want[i] {
+				t.Errorf("write-to '%s': backend %d stored = %v, want %v", tt.writeTo, i+1, err == nil, tt.want[i])
+			}
+		}
+
+		if ok, err := chain.Remove(t.Context(), key); !ok || err != nil {
+			t.Errorf("Remove() = %v, %v", ok, err)
+		}
+		if _, _, err := chain.Get(t.Context(), key); err == nil {
+			t.Errorf("write-to '%s': entry still present after Remove()", tt.writeTo)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+// checksumMagic starts every object written by the checksum layer. It is
+// followed by the CRC32C of the value (4 bytes) and its size (8 bytes),
+// both little endian.
+var checksumMagic = []byte{'c', 'A', 'c', 0x01}
+
+const (
+	checksumHeaderSize   = 4 + 4 + 8
+	checksumEvictTimeout = 30 * time.Second
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// ChecksummedStorageBackend records a CRC32C of every value and verifies it
+// while the value is streamed to ccache. Corrupt objects are removed from
+// the wrapped backend in the background.
+type ChecksummedStorageBackend struct {
+	inner Backend
+
+	corrupt   atomic.Int64
+	evictions sync.WaitGroup
+}
+
+// NewChecksummedBackend wraps inner with checksum verification. Objects
+// stored without checksum are served unverified.
+func NewChecksummedBackend(inner Backend, attributes []Attribute) *ChecksummedStorageBackend {
+	return &ChecksummedStorageBackend{inner: inner}
+}
+
+// Corrupt returns the number of corrupt objects found so far.
+func (h *ChecksummedStorageBackend) Corrupt() int64 {
+	return h.corrupt.Load()
+}
+
+func (h *ChecksummedStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// Get returns the value of key. The value can only be verified once it is
+// read completely, so a mismatch is reported by the Read which would return
+// its last bytes: the caller must discard what it read so far.
+func (h *ChecksummedStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	body, size, err := h.inner.Get(ctx, key)
+	if err != nil {
+		return nil, 0, wrappedFailure(h.inner, err)
+	}
+	return h.decode(key, body, size)
+}
+
+// GetBatch looks up keys with a batch of the wrapped backend and decodes
+// each value found like Get.
+func (h *ChecksummedStorageBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	return decodeBatch(ctx, h.inner, keys, concurrency, h.decode)
+}
+
+// decode returns the value of the object body read for key, checked
+// against its checksum as it is read.
+func (h *ChecksummedStorageBackend) decode(key []byte, body io.ReadCloser, size int64) (io.ReadCloser, int64, error) {
+	reader := bufio.NewReader(body)
+	header, _ := reader.Peek(checksumHeaderSize)
+	if len(header) < checksumHeaderSize || !bytes.HasPrefix(header, checksumMagic) {
+		// Stored without checksum layer.
+		return &checksumReader{reader: reader, body: body}, size, nil
+	}
+	reader.Discard(checksumHeaderSize)
+
+	size = int64(binary.LittleEndian.Uint64(header[8:]))
+	return &checksumReader{
+		reader:    reader,
+		body:      body,
+		backend:   h,
+		key:       bytes.Clone(key),
+		hash:      crc32.New(crc32cTable),
+		checksum:  binary.LittleEndian.Uint32(header[4:]),
+		remaining: size,
+	}, size, nil
+}
+
+// Put stores the value of key along with its checksum.
+func (h *ChecksummedStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	object := make([]byte, 0, checksumHeaderSize+len(data))
+	object = append(object, checksumMagic...)
+	object = binary.LittleEndian.AppendUint32(object, crc32.Checksum(data, crc32cTable))
+	object = binary.LittleEndian.AppendUint64(object, uint64(len(data)))
+	object = append(object, data...)
+
+	ok, err := h.inner.Put(ctx, key, object, onlyIfMissing)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// PutStream reads the value into memory, as its checksum precedes it
+// in the stored object.
+func (h *ChecksummedStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Stat looks the value up with Get, as only its header holds the size of
+// the value.
+func (h *ChecksummedStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	return statByGet(ctx, h, key)
+}
+
+func (h *ChecksummedStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	ok, err := h.inner.Remove(ctx, key)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// evict removes the corrupt object stored under key. It runs in the
+// background, beyond the request which read the object, for at most 30
+// seconds.
+func (h *ChecksummedStorageBackend) evict(key []byte, reason error) {
+	h.corrupt.Add(1)
+	LOG("Object %x is corrupt (%v), removing it", key, reason)
+	h.evictions.Add(1)
+	go func() {
+		defer h.evictions.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), checksumEvictTimeout)
+		defer cancel()
+		if _, err := h.inner.Remove(ctx, key); err != nil {
+			LOG("Failed to remove corrupt object %x: %v", key, err)
+		}
+	}()
+}
+
+// checksumReader verifies the value read from body. A nil hash disables the
+// verification, for objects stored without checksum.
+type checksumReader struct {
+	reader *bufio.Reader
+	body   io.ReadCloser
+
+	backend   *ChecksummedStorageBackend
+	key       []byte
+	hash      hash.Hash32
+	checksum  uint32
+	remaining int64
+	err       error
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	if r.hash == nil {
+		return r.reader.Read(p)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.remaining -= int64(n)
+
+	switch {
+	case r.remaining == 0 && r.hash.Sum32() != r.checksum:
+		r.err = errChecksumMismatch
+	case r.remaining > 0 && err == io.EOF:
+		r.err = io.ErrUnexpectedEOF
+	case err != nil && err != io.EOF:
+		return n, err
+	}
+
+	if r.err != nil {
+		// Withhold the last bytes, so the caller can't miss the failure.
+		r.backend.evict(r.key, r.err)
+		return 0, fmt.Errorf("object %x is corrupt: %w", r.key, r.err)
+	}
+	return n, nil
+}
+
+func (r *checksumReader) Close() error {
+	return r.body.Close()
+}
+
+// Drain waits for the corrupt objects being removed, then for the
+// background requests of the wrapped backend.
+func (h *ChecksummedStorageBackend) Drain() {
+	h.evictions.Wait()
+	drain(h.inner)
+}
@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+)
+
+func TestChecksummedStorageBackend(t *testing.T) {
+	inner := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	checksummed := NewChecksummedBackend(inner, nil)
+
+	key, value := []byte{0x01, 0x02, 0x03}, bytes.Repeat([]byte("object code "), 1000)
+	if ok, err := checksummed.Put(t.Context(), key, value, false); !ok || err != nil {
+		t.Fatalf("Put() = %v, %v", ok, err)
+	}
+	if data := readAll(t, checksummed, key); !bytes.Equal(data, value) {
+		t.Errorf("Get() returned %d bytes, want the %d stored", len(data), len(value))
+	}
+
+	// Written before the checksum layer was enabled.
+	legacy := []byte{0x04, 0x05, 0x06}
+	inner.Put(t.Context(), legacy, value, false)
+	if data := readAll(t, checksummed, legacy); !bytes.Equal(data, value) {
+		t.Errorf("Get() of legacy object returned %d bytes, want %d", len(data), len(value))
+	}
+}
+
+func TestChecksummedStorageBackend_Corrupt(t *testing.T) {
+	value := bytes.Repeat([]byte("object code "), 1000)
+
+	tests := []struct {
+		name    string
+		corrupt func(object []byte) []byte
+		want    error
+	}{
+		{"flipped bit", func(object []byte) []byte {
+			object[len(object)/2] ^= 0x01
+			return object
+		}, errChecksumMismatch},
+		{"truncated", func(object []byte) []byte {
+			return object[:len(object)-100]
+		}, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+			checksummed := NewChecksummedBackend(inner, nil)
+			key := []byte{0x01, 0x02, 0x03}
+
+			checksummed.Put(t.Context(), key, value, false)
+			inner.Put(t.Context(), key, tt.corrupt(readAll(t, inner, key)), false)
+
+			body, size, err := checksummed.Get(t.Context(), key)
+			if err != nil {
+				t.Fatalf("Get() failed: %v", err)
+			}
+			// Read like Serializer.Finalize, which never reads past size.
+			written, err := io.CopyN(io.Discard, body, size)
+			body.Close()
+			if !errors.Is(err, tt.want) {
+				t.Errorf("reading corrupt value failed with %v, want %v", err, tt.want)
+			}
+			if written >= size {
+				t.Errorf("all %d bytes of the corrupt value were returned", size)
+			}
+
+			checksummed.Drain()
+			if _, _, err := inner.Get(t.Context(), key); err == nil {
+				t.Fatal("corrupt object was not removed")
+			}
+			if checksummed.Corrupt() != 1 {
+				t.Errorf("Corrupt() = %d, want 1", checksummed.Corrupt())
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"ccache-backend-client/internal/constants"
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const coalesceDefaultMaxSize = 8 << 20
+
+// CoalescingStorageBackend collapses identical concurrent requests into a
+// single request to the wrapped backend. A parallel build often looks up
+// the same key from many connections at once. A shared Get isn't canceled
+// with the request which started it, but once all requests waiting for it
+// gave up; a shared Put runs within the deadline of the request which
+// started it.
+type CoalescingStorageBackend struct {
+	inner   Backend
+	maxSize int64
+	puts    singleflight.Group
+
+	mu   sync.Mutex
+	gets map[string]*getCall
+
+	coalesced atomic.Int64
+}
+
+// getCall is a Get of a key shared by concurrent requests.
+type getCall struct {
+	done   chan struct{} // closed once the result is set
+	cancel context.CancelFunc
+
+	// Guarded by CoalescingStorageBackend.mu
+	waiters int
+	body    io.ReadCloser // until claimed by a waiter
+
+	// Set before done is closed
+	data []byte // the value, if read for several waiters
+	size int64
+	err  error
+}
+
+// NewCoalescingBackend wraps inner with request coalescing. A value looked
+// up by several requests at once is read into memory if it is at most
+// "coalesce-max-size" bytes (default 8Mi); larger ones are fetched by each
+// request.
+func NewCoalescingBackend(inner Backend, attributes []Attribute) *CoalescingStorageBackend {
+	h := &CoalescingStorageBackend{
+		inner:   inner,
+		maxSize: coalesceDefaultMaxSize,
+		gets:    make(map[string]*getCall),
+	}
+	if value := findAttribute(attributes, "coalesce-max-size"); value != "" {
+		if size, err := parseSize(value); err != nil {
+			LOG("Invalid coalesce-max-size '%s', using %d", value, h.maxSize)
+		} else {
+			h.maxSize = size
+		}
+	}
+	return h
+}
+
+// Coalesced returns the number of requests served by another one in flight.
+func (h *CoalescingStorageBackend) Coalesced() int64 {
+	return h.coalesced.Load()
+}
+
+func (h *CoalescingStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// Get returns the value of key. Concurrent Gets of the same key share one
+// request. Its value is streamed if a single request is still waiting for
+// it, and otherwise read into memory and handed to each of them, within
+// the size limit.
+func (h *CoalescingStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	h.mu.Lock()
+	call, ok := h.gets[string(key)]
+	if ok {
+		h.coalesced.Add(1)
+	} else {
+		call = h.startGet(ctx, key)
+	}
+	call.waiters++
+	h.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		h.leave(key, call)
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Get of %x abandoned: %v", key, ctx.Err()),
+			Code:    TIMEOUT}
+	}
+
+	h.mu.Lock()
+	body := call.body
+	call.body = nil
+	call.waiters--
+	h.mu.Unlock()
+
+	switch {
+	case call.err != nil:
+		return nil, 0, call.err
+	case body != nil:
+		// The reading is bounded by this request from now on.
+		stop := context.AfterFunc(ctx, call.cancel)
+		return &coalescedBody{ReadCloser: body, stop: stop, cancel: call.cancel}, call.size, nil
+	case call.data != nil:
+		return io.NopCloser(bytes.NewReader(call.data)), call.size, nil
+	default:
+		// The value is too large to share and another request streams it.
+		body, size, err := h.inner.Get(ctx, key)
+		if err != nil {
+			return nil, 0, wrappedFailure(h.inner, err)
+		}
+		return body, size, nil
+	}
+}
+
+// GetBatch passes the batch on to the wrapped backend as a whole. It isn't
+// coalesced with the Gets in flight, which would split it up again.
+func (h *CoalescingStorageBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	return forwardBatch(ctx, h.inner, keys, concurrency)
+}
+
+// startGet starts the shared Get of key, bounded by the longest operation
+// timeout ccache can negotiate. h.mu is held.
+func (h *CoalescingStorageBackend) startGet(ctx context.Context, key []byte) *getCall {
+	shared, cancel := context.WithTimeout(context.WithoutCancel(ctx), constants.MAX_OPERATION_TIMEOUT)
+	call := &getCall{done: make(chan struct{}), cancel: cancel}
+	h.gets[string(key)] = call
+	go h.fetch(shared, bytes.Clone(key), call)
+	return call
+}
+
+// fetch runs the shared Get of key. The body is handed to a waiter if only
+// one is left or the value is too large to share, otherwise the value is
+// read into memory for all of them.
+func (h *CoalescingStorageBackend) fetch(ctx context.Context, key []byte, call *getCall) {
+	body, size, err := h.inner.Get(ctx, key)
+
+	h.mu.Lock()
+	if h.gets[string(key)] == call {
+		delete(h.gets, string(key)) // later Gets start a new request
+	}
+	waiters := call.waiters
+	if err == nil && waiters > 0 && (waiters == 1 || size < 0 || size > h.maxSize) {
+		// One waiter streams the value, the others fetch it themselves.
+		call.body, call.size = body, size
+		close(call.done)
+		h.mu.Unlock()
+		return
+	}
+	h.mu.Unlock()
+
+	defer close(call.done)
+	defer call.cancel()
+	if err != nil {
+		call.err = wrappedFailure(h.inner, err)
+		return
+	}
+	defer body.Close()
+	if waiters == 0 {
+		return
+	}
+
+	data, err := readValue(body, size)
+	if err != nil {
+		call.err = &BackendFailure{
+			Message: fmt.Sprintf("Failed to read %x: %v", key, err),
+			Code:    ERROR}
+		return
+	}
+	call.data, call.size = data, size
+}
+
+// leave removes a waiter which gave up on call. The shared Get is canceled
+// once nobody waits for it, and its body closed if nobody claimed it.
+func (h *CoalescingStorageBackend) leave(key []byte, call *getCall) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	if h.gets[string(key)] == call {
+		delete(h.gets, string(key))
+	}
+	if call.body != nil {
+		call.body.Close()
+		call.body = nil
+	}
+	call.cancel()
+}
+
+// coalescedBody is the body of a shared Get claimed by a single waiter. It
+// releases the shared context once closed.
+type coalescedBody struct {
+	io.ReadCloser
+	stop   func() bool
+	cancel context.CancelFunc
+}
+
+func (b *coalescedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stop()
+	b.cancel()
+	return err
+}
+
+// Put stores the value of key. Concurrent Puts of the same key with
+// onlyIfMissing share one request, as only one of them can store a value.
+func (h *CoalescingStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	if !onlyIfMissing {
+		ok, err := h.inner.Put(ctx, key, data, onlyIfMissing)
+		if err != nil {
+			return false, wrappedFailure(h.inner, err)
+		}
+		return ok, nil
+	}
+
+	leader := false
+	value, err, _ := h.puts.Do(string(key), func() (any, error) {
+		leader = true
+		ok, err := h.inner.Put(ctx, key, data, onlyIfMissing)
+		if err != nil {
+			return nil, wrappedFailure(h.inner, err)
+		}
+		return ok, nil
+	})
+	if !leader {
+		h.coalesced.Add(1)
+	}
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+// PutStream stores the value read from r like Put. The values of coalesced
+// requests are left unread.
+func (h *CoalescingStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	put := func() (bool, error) {
+		ok, err := h.inner.PutStream(ctx, key, r, size, onlyIfMissing)
+		if err != nil {
+			return false, wrappedFailure(h.inner, err)
+		}
+		return ok, nil
+	}
+	if !onlyIfMissing {
+		return put()
+	}
+
+	leader := false
+	value, err, _ := h.puts.Do(string(key), func() (any, error) {
+		leader = true
+		return put()
+	})
+	if !leader {
+		h.coalesced.Add(1)
+	}
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+func (h *CoalescingStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	ok, err := h.inner.Remove(ctx, key)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// Stat isn't coalesced, its response is cheap.
+func (h *CoalescingStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	info, err := h.inner.Stat(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, wrappedFailure(h.inner, err)
+	}
+	return info, nil
+}
+
+func (h *CoalescingStorageBackend) Drain() {
+	drain(h.inner)
+}
@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedBackend counts the requests and holds them until released.
+type gatedBackend struct {
+	Backend
+	entered chan struct{}
+	release chan struct{}
+	calls   atomic.Int64
+}
+
+func newGatedBackend(inner Backend) *gatedBackend {
+	return &gatedBackend{Backend: inner, entered: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (g *gatedBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	g.calls.Add(1)
+	g.entered <- struct{}{}
+	<-g.release
+	return g.Backend.Get(ctx, key)
+}
+
+func (g *gatedBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	g.calls.Add(1)
+	g.entered <- struct{}{}
+	<-g.release
+	return g.Backend.Put(ctx, key, data, onlyIfMissing)
+}
+
+// runConcurrently runs n requests, the first of which holds the others
+// behind it until it is released.
+func runConcurrently(gated *gatedBackend, n int, request func()) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	go func() {
+		defer wg.Done()
+		request()
+	}()
+	<-gated.entered
+	for range n - 1 {
+		go func() {
+			defer wg.Done()
+			request()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gated.release)
+	wg.Wait()
+}
+
+func TestCoalescingStorageBackend_Get(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	gated := newGatedBackend(files)
+	coalescing := NewCoalescingBackend(gated, nil)
+
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+	files.Put(t.Context(), key, value, false)
+
+	var failed atomic.Int64
+	runConcurrently(gated, 10, func() {
+		body, size, err := coalescing.Get(t.Context(), key)
+		if err != nil {
+			failed.Add(1)
+			return
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if !bytes.Equal(data, value) || size != int64(len(value)) {
+			failed.Add(1)
+		}
+	})
+
+	if failed.Load() != 0 {
+		t.Errorf("%d of the coalesced Gets did not return the value", failed.Load())
+	}
+	if calls := gated.calls.Load(); calls != 1 || coalescing.Coalesced() != 9 {
+		t.Errorf("10 concurrent Gets made %d calls, %d coalesced", calls, coalescing.Coalesced())
+	}
+
+	// Requests which don't overlap aren't coalesced, and misses are shared.
+	gated.entered = make(chan struct{}, 100)
+	readAll(t, coalescing, key)
+	if _, _, err := coalescing.Get(t.Context(), []byte{0x04, 0x05, 0x06}); err == nil {
+		t.Error("Get() of a missing key should fail")
+	}
+	if calls := gated.calls.Load(); calls != 3 {
+		t.Errorf("sequential Gets made %d calls in total, want 3", calls)
+	}
+}
+
+func TestCoalescingStorageBackend_GetStreams(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	coalescing := NewCoalescingBackend(files, []Attribute{{Key: "coalesce-max-size", Value: "4"}})
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+	files.Put(t.Context(), key, value, false)
+
+	// An uncontended Get isn't read into memory.
+	body, _, err := coalescing.Get(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	if _, ok := body.(*coalescedBody); !ok {
+		t.Errorf("Get() without concurrent requests returned a %T, want the streamed body", body)
+	}
+	body.Close()
+
+	// A value too large to share is fetched by each request.
+	gated := newGatedBackend(files)
+	coalescing = NewCoalescingBackend(gated, []Attribute{{Key: "coalesce-max-size", Value: "4"}})
+	var failed atomic.Int64
+	runConcurrently(gated, 5, func() {
+		body, _, err := coalescing.Get(t.Context(), key)
+		if err != nil {
+			failed.Add(1)
+			return
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if !bytes.Equal(data, value) {
+			failed.Add(1)
+		}
+	})
+	if failed.Load() != 0 || gated.calls.Load() != 5 {
+		t.Errorf("%d of 5 Gets of a large value failed, %d calls made", failed.Load(), gated.calls.Load())
+	}
+}
+
+func TestCoalescingStorageBackend_GetLeaderCanceled(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	gated := newGatedBackend(files)
+	coalescing := NewCoalescingBackend(gated, nil)
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+	files.Put(t.Context(), key, value, false)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	leader := make(chan error)
+	go func() {
+		_, _, err := coalescing.Get(ctx, key)
+		leader <- err
+	}()
+	<-gated.entered
+
+	follower := make(chan []byte)
+	go func() {
+		body, _, err := coalescing.Get(t.Context(), key)
+		if err != nil {
+			follower <- nil
+			return
+		}
+		defer body.Close()
+		data, _ := io.ReadAll(body)
+		follower <- data
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-leader; err == nil {
+		t.Error("Get() of a canceled request should fail")
+	}
+
+	close(gated.release)
+	if data := <-follower; !bytes.Equal(data, value) {
+		t.Errorf("Get() coalesced with a canceled request = %q, want %q", data, value)
+	}
+}
+
+func TestCoalescingStorageBackend_Put(t *testing.T) {
+	gated := newGatedBackend(NewFileBackend(&url.URL{Path: t.TempDir()}, nil))
+	coalescing := NewCoalescingBackend(gated, nil)
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+
+	runConcurrently(gated, 5, func() { coalescing.Put(t.Context(), key, value, true) })
+	if calls := gated.calls.Load(); calls != 1 {
+		t.Errorf("5 concurrent Puts with onlyIfMissing made %d calls, want 1", calls)
+	}
+
+	gated = newGatedBackend(NewFileBackend(&url.URL{Path: t.TempDir()}, nil))
+	coalescing = NewCoalescingBackend(gated, nil)
+	runConcurrently(gated, 5, func() { coalescing.Put(t.Context(), key, value, false) })
+	if calls := gated.calls.Load(); calls != 5 {
+		t.Errorf("5 concurrent overwriting Puts made %d calls, want 5", calls)
+	}
+}
@@ -0,0 +1,201 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressDefaultLevel   = 3
+	compressDefaultMinSize = 1 << 10
+
+	compressMethodNone = 0
+	compressMethodZstd = 1
+)
+
+// compressMagic starts every object written by the compression layer. It is
+// followed by the method byte and the uncompressed size (8 bytes, little
+// endian). Objects without it were stored without the layer and are served
+// unchanged.
+var compressMagic = []byte{'c', 'A', 'z', 0x01}
+
+const compressHeaderSize = 4 + 1 + 8
+
+// CompressedStorageBackend compresses values with zstd before storing them
+// in the wrapped backend and decompresses them on Get.
+type CompressedStorageBackend struct {
+	inner   Backend
+	encoder *zstd.Encoder
+	minSize int64
+}
+
+// NewCompressedBackend wraps inner with zstd compression.
+//
+// The "compression-level" attribute sets the zstd level (default 3) and
+// "compression-min-size" the size below which values are stored as they are
+// (default 1Ki, same suffixes as local-cache-max-size).
+func NewCompressedBackend(inner Backend, attributes []Attribute) *CompressedStorageBackend {
+	level := compressDefaultLevel
+	if value := findAttribute(attributes, "compression-level"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 22 {
+			LOG("Invalid compression-level '%s', using %d", value, level)
+		} else {
+			level = n
+		}
+	}
+
+	minSize := int64(compressDefaultMinSize)
+	if value := findAttribute(attributes, "compression-min-size"); value != "" {
+		if size, err := parseSize(value); err != nil {
+			LOG("Invalid compression-min-size: %v", err)
+		} else {
+			minSize = size
+		}
+	}
+
+	// EncodeAll is safe for concurrent use, one encoder serves all requests.
+	encoder, _ := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1))
+
+	return &CompressedStorageBackend{
+		inner:   inner,
+		encoder: encoder,
+		minSize: minSize,
+	}
+}
+
+func (h *CompressedStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// encode returns the object stored for data. Values below the minimum size
+// or not shrinking are stored as they are, unless they could be mistaken for
+// a compressed object.
+func (h *CompressedStorageBackend) encode(data []byte) []byte {
+	if int64(len(data)) >= h.minSize {
+		object := appendCompressHeader(make([]byte, 0, compressHeaderSize+len(data)/2), compressMethodZstd, len(data))
+		object = h.encoder.EncodeAll(data, object)
+		if len(object) < len(data) {
+			return object
+		}
+	}
+
+	if bytes.HasPrefix(data, compressMagic) {
+		object := appendCompressHeader(make([]byte, 0, compressHeaderSize+len(data)), compressMethodNone, len(data))
+		return append(object, data...)
+	}
+	return data
+}
+
+func appendCompressHeader(object []byte, method byte, size int) []byte {
+	object = append(object, compressMagic...)
+	object = append(object, method)
+	return binary.LittleEndian.AppendUint64(object, uint64(size))
+}
+
+// Get returns the decompressed value of key. Its size is the uncompressed
+// size recorded in the header, as the response announces the length of the
+// value before streaming it.
+func (h *CompressedStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	body, size, err := h.inner.Get(ctx, key)
+	if err != nil {
+		return nil, 0, wrappedFailure(h.inner, err)
+	}
+	return h.decode(key, body, size)
+}
+
+// GetBatch looks up keys with a batch of the wrapped backend and decodes
+// each value found like Get.
+func (h *CompressedStorageBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	return decodeBatch(ctx, h.inner, keys, concurrency, h.decode)
+}
+
+// decode returns the decompressed value of the object body read for key.
+func (h *CompressedStorageBackend) decode(key []byte, body io.ReadCloser, size int64) (io.ReadCloser, int64, error) {
+	reader := bufio.NewReader(body)
+	header, _ := reader.Peek(compressHeaderSize)
+	if len(header) < compressHeaderSize || !bytes.HasPrefix(header, compressMagic) {
+		// Stored without compression layer.
+		return &compressedReader{Reader: reader, body: body}, size, nil
+	}
+	reader.Discard(compressHeaderSize)
+	size = int64(binary.LittleEndian.Uint64(header[5:]))
+
+	switch method := header[4]; method {
+	case compressMethodNone:
+		return &compressedReader{Reader: reader, body: body}, size, nil
+	case compressMethodZstd:
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			body.Close()
+			return nil, 0, &BackendFailure{
+				Message: fmt.Sprintf("Failed to decompress %x: %v", key, err),
+				Code:    ERROR}
+		}
+		return &compressedReader{Reader: decoder, body: body, decoder: decoder}, size, nil
+	default:
+		body.Close()
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Unknown compression method %d for %x", method, key),
+			Code:    ERROR}
+	}
+}
+
+// Put stores the compressed value of key.
+func (h *CompressedStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	ok, err := h.inner.Put(ctx, key, h.encode(data), onlyIfMissing)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// PutStream reads the value into memory, as the compressed object is
+// stored with its size.
+func (h *CompressedStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Stat looks the value up with Get, as only its header holds the size of
+// the uncompressed value.
+func (h *CompressedStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	return statByGet(ctx, h, key)
+}
+
+func (h *CompressedStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	ok, err := h.inner.Remove(ctx, key)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// compressedReader reads a value from the body returned by the wrapped
+// backend and releases both on Close.
+type compressedReader struct {
+	io.Reader
+	body    io.ReadCloser
+	decoder *zstd.Decoder
+}
+
+func (r *compressedReader) Close() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+	return r.body.Close()
+}
+
+func (h *CompressedStorageBackend) Drain() {
+	drain(h.inner)
+}
@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/url"
+	"testing"
+)
+
+func TestCompressedStorageBackend(t *testing.T) {
+	inner := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	compressed := NewCompressedBackend(inner, []Attribute{{Key: "compression-min-size", Value: "64"}})
+
+	tests := []struct {
+		name       string
+		value      []byte
+		compressed bool
+	}{
+		{"large value", bytes.Repeat([]byte("object code "), 1000), true},
+		{"small value", []byte("tiny"), false},
+		{"incompressible value", random(256), false},
+		{"value looking compressed", append(append([]byte{}, compressMagic...), []byte("\x01 legacy")...), true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := []byte{0x01, 0x02, byte(i)}
+			if ok, err := compressed.Put(t.Context(), key, tt.value, false); !ok || err != nil {
+				t.Fatalf("Put() = %v, %v", ok, err)
+			}
+
+			stored := readAll(t, inner, key)
+			if hasHeader := bytes.HasPrefix(stored, compressMagic); hasHeader != tt.compressed {
+				t.Errorf("stored object has header = %v, want %v", hasHeader, tt.compressed)
+			}
+			if data := readAll(t, compressed, key); !bytes.Equal(data, tt.value) {
+				t.Errorf("Get() = %q, want %q", data, tt.value)
+			}
+		})
+	}
+
+	large := tests[0].value
+	if stored := readAll(t, inner, []byte{0x01, 0x02, 0x00}); len(stored) >= len(large)/10 {
+		t.Errorf("stored %d bytes for %d compressible bytes", len(stored), len(large))
+	}
+}
+
+func TestCompressedStorageBackend_Legacy(t *testing.T) {
+	inner := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	compressed := NewCompressedBackend(inner, nil)
+
+	// Written before the compression layer was enabled.
+	key := []byte{0x01, 0x02, 0x03}
+	legacy := bytes.Repeat([]byte("cCrS legacy entry "), 100)
+	inner.Put(t.Context(), key, legacy, false)
+
+	body, size, err := compressed.Get(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(body)
+	if !bytes.Equal(data, legacy) || size != int64(len(legacy)) {
+		t.Errorf("Get() = %d bytes (size %d), want the %d legacy bytes", len(data), size, len(legacy))
+	}
+}
+
+func random(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
@@ -0,0 +1,209 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+// encryptMagic starts every object written by the encryption layer. It is
+// followed by the length of the key ID (1 byte), the key ID, the nonce and
+// the AES-GCM sealed value.
+var encryptMagic = []byte{'c', 'A', 'e', 0x01}
+
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// EncryptedStorageBackend seals values with AES-256-GCM before storing them
+// in the wrapped backend. Objects name the key they were sealed with, so
+// after a key rotation objects sealed with older keys remain readable.
+type EncryptedStorageBackend struct {
+	inner   Backend
+	current *encryptionKey
+	keys    map[string]*encryptionKey
+}
+
+// NewEncryptedBackend wraps inner with encryption using the keys read from
+// the file named by the "encryption-key-file" attribute or the environment
+// variable named by "encryption-key-env".
+//
+// Keys are given as whitespace or comma separated ID:KEY pairs, KEY being 32
+// base64 encoded bytes. The first key seals new objects, all of them are
+// used for reading.
+func NewEncryptedBackend(inner Backend, attributes []Attribute) (*EncryptedStorageBackend, error) {
+	var text string
+	if file := findAttribute(attributes, "encryption-key-file"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption keys: %v", err)
+		}
+		text = string(data)
+	} else if name := findAttribute(attributes, "encryption-key-env"); name != "" {
+		text = os.Getenv(name)
+	}
+
+	keys, err := parseEncryptionKeys(text)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &EncryptedStorageBackend{
+		inner:   inner,
+		current: keys[0],
+		keys:    make(map[string]*encryptionKey),
+	}
+	for _, key := range keys {
+		h.keys[key.id] = key
+	}
+	return h, nil
+}
+
+func parseEncryptionKeys(text string) ([]*encryptionKey, error) {
+	var keys []*encryptionKey
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	for _, field := range fields {
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("encryption key must be given as ID:KEY")
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(secret) != 32 {
+			return nil, fmt.Errorf("encryption key %s must be 32 base64 encoded bytes", id)
+		}
+
+		block, _ := aes.NewCipher(secret)
+		aead, _ := cipher.NewGCM(block)
+		keys = append(keys, &encryptionKey{id: id, aead: aead})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption keys configured")
+	}
+	return keys, nil
+}
+
+func (h *EncryptedStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// seal returns the object stored for data. The header and the cache key are
+// authenticated too, so an object can't be moved to another key.
+func (h *EncryptedStorageBackend) seal(key []byte, data []byte) []byte {
+	nonce := make([]byte, h.current.aead.NonceSize())
+	rand.Read(nonce)
+
+	header := append([]byte{}, encryptMagic...)
+	header = append(header, byte(len(h.current.id)))
+	header = append(header, h.current.id...)
+	header = append(header, nonce...)
+
+	additional := append(append([]byte{}, header...), key...)
+	return h.current.aead.Seal(header, nonce, data, additional)
+}
+
+// open returns the value sealed in object.
+func (h *EncryptedStorageBackend) open(key []byte, object []byte) ([]byte, error) {
+	if !bytes.HasPrefix(object, encryptMagic) || len(object) <= len(encryptMagic) {
+		return nil, fmt.Errorf("not encrypted")
+	}
+
+	idEnd := len(encryptMagic) + 1 + int(object[len(encryptMagic)])
+	if len(object) < idEnd {
+		return nil, fmt.Errorf("truncated header")
+	}
+	id := string(object[len(encryptMagic)+1 : idEnd])
+	secret, ok := h.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %s not known", id)
+	}
+
+	headerEnd := idEnd + secret.aead.NonceSize()
+	if len(object) < headerEnd {
+		return nil, fmt.Errorf("truncated header")
+	}
+	additional := append(append([]byte{}, object[:headerEnd]...), key...)
+	return secret.aead.Open(nil, object[idEnd:headerEnd], object[headerEnd:], additional)
+}
+
+// Get returns the decrypted value of key. Objects failing to decrypt are
+// reported as a miss, so ccache never receives their content.
+func (h *EncryptedStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	body, size, err := h.inner.Get(ctx, key)
+	if err != nil {
+		return nil, 0, wrappedFailure(h.inner, err)
+	}
+	return h.decode(key, body, size)
+}
+
+// GetBatch looks up keys with a batch of the wrapped backend and decodes
+// each value found like Get.
+func (h *EncryptedStorageBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	return decodeBatch(ctx, h.inner, keys, concurrency, h.decode)
+}
+
+// decode returns the decrypted value of the object body read for key.
+func (h *EncryptedStorageBackend) decode(key []byte, body io.ReadCloser, size int64) (io.ReadCloser, int64, error) {
+	object, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Failed to read %x: %v", key, err),
+			Code:    ERROR}
+	}
+
+	data, err := h.open(key, object)
+	if err != nil {
+		LOG("Failed to decrypt %x, treating it as a miss: %v", key, err)
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Failed to decrypt %x: %v", key, err),
+			Code:    NO_FILE}
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// Put stores the encrypted value of key.
+func (h *EncryptedStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	ok, err := h.inner.Put(ctx, key, h.seal(key, data), onlyIfMissing)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// PutStream reads the value into memory, as AES-GCM seals it as a
+// whole.
+func (h *EncryptedStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Stat looks the value up with Get, as the stored object is larger than
+// the value.
+func (h *EncryptedStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	return statByGet(ctx, h, key)
+}
+
+func (h *EncryptedStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	ok, err := h.inner.Remove(ctx, key)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+func (h *EncryptedStorageBackend) Drain() {
+	drain(h.inner)
+}
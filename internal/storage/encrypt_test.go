@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newEncryptionKey(id string, fill byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+func TestEncryptedStorageBackend(t *testing.T) {
+	inner := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	t.Setenv("CCACHE_TEST_KEYS", newEncryptionKey("v1", 0x11))
+	encrypted, err := NewEncryptedBackend(inner, []Attribute{{Key: "encryption-key-env", Value: "CCACHE_TEST_KEYS"}})
+	if err != nil {
+		t.Fatalf("NewEncryptedBackend() failed: %v", err)
+	}
+
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("secret object code")
+	if ok, err := encrypted.Put(t.Context(), key, value, false); !ok || err != nil {
+		t.Fatalf("Put() = %v, %v", ok, err)
+	}
+	if stored := readAll(t, inner, key); bytes.Contains(stored, value) {
+		t.Error("value is stored in plain text")
+	}
+	if data := readAll(t, encrypted, key); !bytes.Equal(data, value) {
+		t.Errorf("Get() = %q, want %q", data, value)
+	}
+
+	// Rotate: the new key seals, the old one still opens.
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keyFile, []byte(newEncryptionKey("v2", 0x22)+"\n"+newEncryptionKey("v1", 0x11)+"\n"), 0600)
+	rotated, err := NewEncryptedBackend(inner, []Attribute{{Key: "encryption-key-file", Value: keyFile}})
+	if err != nil {
+		t.Fatalf("NewEncryptedBackend() failed: %v", err)
+	}
+	if data := readAll(t, rotated, key); !bytes.Equal(data, value) {
+		t.Errorf("Get() after rotation = %q, want %q", data, value)
+	}
+
+	rotated.Put(t.Context(), key, value, false)
+	if _, _, err := encrypted.Get(t.Context(), key); err == nil {
+		t.Error("Get() of an object sealed with an unknown key should fail")
+	}
+}
+
+func TestEncryptedStorageBackend_Undecryptable(t *testing.T) {
+	inner := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	t.Setenv("CCACHE_TEST_KEYS", newEncryptionKey("v1", 0x11))
+	encrypted, _ := NewEncryptedBackend(inner, []Attribute{{Key: "encryption-key-env", Value: "CCACHE_TEST_KEYS"}})
+
+	key, other := []byte{0x01, 0x02, 0x03}, []byte{0x04, 0x05, 0x06}
+	encrypted.Put(t.Context(), key, []byte("object code"), false)
+	sealed := readAll(t, inner, key)
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 0x01
+
+	tests := []struct {
+		name   string
+		key    []byte
+		object []byte
+	}{
+		{"tampered", key, tampered},
+		{"moved to another key", other, sealed},
+		{"plain text", key, []byte("object code")},
+		{"truncated", key, sealed[:len(encryptMagic)+2]},
+	}
+
+	for _, tt := range tests {
+		inner.Put(t.Context(), tt.key, tt.object, false)
+		_, _, err := encrypted.Get(t.Context(), tt.key)
+		if err == nil {
+			t.Errorf("Get() of %s object should fail", tt.name)
+		} else if code := encrypted.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+			t.Errorf("Get() of %s object resolved to %d, want NO_FILE", tt.name, code)
+		}
+	}
+}
+
+func TestNewEncryptedBackend_InvalidKeys(t *testing.T) {
+	for _, keys := range []string{"", "v1", "v1:c2hvcnQ=", newEncryptionKey("", 0x11)} {
+		t.Setenv("CCACHE_TEST_KEYS", keys)
+		if _, err := NewEncryptedBackend(nil, []Attribute{{Key: "encryption-key-env", Value: "CCACHE_TEST_KEYS"}}); err == nil {
+			t.Errorf("NewEncryptedBackend() with keys %q should fail", keys)
+		}
+	}
+}
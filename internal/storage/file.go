@@ -0,0 +1,195 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	urlib "net/url"
+	"os"
+	"path/filepath"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+type FileStorageBackend struct {
+	directory string
+	layout    Layout
+}
+
+// NewFileBackend creates a backend for URLs of the form file:///PATH.
+//
+// Entries are stored below PATH using the "flat" or "subdirs" (default)
+// layout, matching ccache's own file storage.
+func NewFileBackend(url *urlib.URL, attributes []Attribute) *FileStorageBackend {
+	layout := subdirs
+	for _, attr := range backendAttributes(attributes) {
+		switch attr.Key {
+		case "layout":
+			layout = parseLayout(attr.Value)
+			if layout == bazel {
+				LOG("Layout 'bazel' not supported for file storage, using flat")
+				layout = flat
+			}
+		default:
+			LOG("File attribute '%s' not known!", attr.Key)
+		}
+	}
+
+	return &FileStorageBackend{
+		directory: filepath.FromSlash(url.Path),
+		layout:    layout,
+	}
+}
+
+func (h *FileStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveHttpStatus(code)
+}
+
+// getEntryPath returns the path of the file holding key.
+func (h *FileStorageBackend) getEntryPath(key []byte) (string, error) {
+	digest, err := formatDigest(key)
+	if err != nil {
+		return "", err
+	}
+	if h.layout == subdirs {
+		return filepath.Join(h.directory, digest[:2], digest[2:]), nil
+	}
+	return filepath.Join(h.directory, digest), nil
+}
+
+// Get opens the file stored for key.
+//
+// The returned reader is the open file itself so the value is streamed to
+// the socket without being buffered.
+func (h *FileStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	path, err := h.getEntryPath(key)
+	if err != nil {
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Local error %x: %v", key, err),
+			Code:    0}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, h.failure("open", path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, h.failure("stat", path, err)
+	}
+
+	return f, info.Size(), nil
+}
+
+// Stat describes the file stored for key.
+func (h *FileStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	path, err := h.getEntryPath(key)
+	if err != nil {
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("Local error %x: %v", key, err),
+			Code:    0}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, h.failure("stat", path, err)
+	}
+	return ObjectInfo{Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+// Put writes data to a temporary file which is then moved into place, so
+// readers never observe a partially written entry.
+//
+// When onlyIfMissing is set the temporary file is hard linked instead of
+// renamed, which fails if the entry exists just like O_EXCL would, and
+// (false, nil) is returned.
+func (h *FileStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	return h.store(key, bytes.NewReader(data), int64(len(data)), onlyIfMissing)
+}
+
+func (h *FileStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return h.store(key, io.LimitReader(r, size), size, onlyIfMissing)
+}
+
+// store implements Put for a value read from r. If size is not negative
+// the entry is only stored when exactly size bytes could be read.
+func (h *FileStorageBackend) store(key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	path, err := h.getEntryPath(key)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Local error %x: %v", key, err),
+			Code:    0}
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, h.failure("create directory", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return false, h.failure("create temporary file in", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("expected %d bytes, got %d", size, written)
+	}
+	if err != nil {
+		tmp.Close()
+		return false, h.failure("write", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, h.failure("close", tmp.Name(), err)
+	}
+	// CreateTemp uses 0600, entries should be shareable like the directory.
+	os.Chmod(tmp.Name(), 0o644)
+
+	if onlyIfMissing {
+		err = os.Link(tmp.Name(), path)
+		if errors.Is(err, fs.ErrExist) {
+			return false, nil // file was found, no need to put again
+		}
+	} else {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return false, h.failure("store", path, err)
+	}
+
+	return true, nil
+}
+
+// Remove deletes the file stored for key.
+func (h *FileStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	path, err := h.getEntryPath(key)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Local error %x: %v", key, err),
+			Code:    0}
+	}
+
+	if err := os.Remove(path); err != nil {
+		return false, h.failure("remove", path, err)
+	}
+	return true, nil
+}
+
+// failure wraps a filesystem error into a BackendFailure, reporting
+// missing files with code 404.
+func (h *FileStorageBackend) failure(op string, path string, err error) *BackendFailure {
+	code := 500
+	if errors.Is(err, fs.ErrNotExist) {
+		code = 404
+	}
+	return &BackendFailure{
+		Message: fmt.Sprintf("Failed to %s %s: %v", op, path, err),
+		Code:    code}
+}
@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorageBackend_PutGetRemove(t *testing.T) {
+	for _, layout := range []string{"flat", "subdirs"} {
+		t.Run(layout, func(t *testing.T) {
+			dir := t.TempDir()
+			u := &url.URL{Scheme: "file", Path: filepath.ToSlash(dir)}
+			backend := NewFileBackend(u, []Attribute{{Key: "layout", Value: layout}})
+			key := []byte{0x01, 0x02, 0x03}
+
+			if _, _, err := backend.Get(t.Context(), key); err == nil {
+				t.Fatal("Get() on empty directory should fail")
+			} else if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+				t.Errorf("Get() miss resolved to %d, want NO_FILE", code)
+			}
+
+			if ok, err := backend.Put(t.Context(), key, []byte("value"), true); !ok || err != nil {
+				t.Fatalf("Put() = %v, %v", ok, err)
+			}
+			if ok, err := backend.Put(t.Context(), key, []byte("other"), true); ok || err != nil {
+				t.Errorf("Put() with onlyIfMissing on existing key = %v, %v", ok, err)
+			}
+
+			digest, _ := formatDigest(key)
+			want := filepath.Join(dir, digest)
+			if layout == "subdirs" {
+				want = filepath.Join(dir, digest[:2], digest[2:])
+			}
+			if _, err := os.Stat(want); err != nil {
+				t.Errorf("entry not stored at %s: %v", want, err)
+			}
+
+			if ok, err := backend.Put(t.Context(), key, []byte("overwritten"), false); !ok || err != nil {
+				t.Fatalf("Put() overwrite = %v, %v", ok, err)
+			}
+
+			body, size, err := backend.Get(t.Context(), key)
+			if err != nil {
+				t.Fatalf("Get() failed: %v", err)
+			}
+			data, _ := io.ReadAll(body)
+			body.Close()
+			if string(data) != "overwritten" || size != int64(len(data)) {
+				t.Errorf("Get() = %q (size %d), want \"overwritten\"", data, size)
+			}
+
+			if ok, err := backend.Remove(t.Context(), key); !ok || err != nil {
+				t.Errorf("Remove() = %v, %v", ok, err)
+			}
+			if _, err := backend.Remove(t.Context(), key); err == nil {
+				t.Error("Remove() of missing key should fail")
+			}
+
+			leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(want), ".tmp-*"))
+			if len(leftovers) != 0 {
+				t.Errorf("temporary files left behind: %v", leftovers)
+			}
+		})
+	}
+}
+
+func TestFileStorageBackend_Stat(t *testing.T) {
+	backend := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	key := []byte{0x01, 0x02, 0x03}
+
+	if _, err := backend.Stat(t.Context(), key); err == nil {
+		t.Fatal("Stat() of a missing key should fail")
+	} else if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+		t.Errorf("Stat() miss resolved to %d, want NO_FILE", code)
+	}
+
+	backend.Put(t.Context(), key, []byte("value"), false)
+	info, err := backend.Stat(t.Context(), key)
+	if err != nil || info.Size != 5 || info.LastModified.IsZero() {
+		t.Errorf("Stat() = %+v, %v, want 5 bytes and a modification time", info, err)
+	}
+}
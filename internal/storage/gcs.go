@@ -1,13 +1,12 @@
 package backend
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	urlib "net/url"
-	"strings"
-	"sync"
 	"time"
 
 	//lint:ignore ST1001 for clean LOG operations
@@ -33,18 +32,6 @@ type GCSStorageBackend struct {
 	timeout      time.Duration
 }
 
-var (
-	gcsBackend *GCSStorageBackend
-	gcsOnce    sync.Once
-)
-
-func GetGCSBackend(url *urlib.URL, attributes []Attribute) *GCSStorageBackend {
-	gcsOnce.Do(func() {
-		gcsBackend = NewGCSBackend(url, attributes)
-	})
-	return gcsBackend
-}
-
 func NewGCSAttributes() *GCSAttributes {
 	return &GCSAttributes{
 		StorageClass: "STANDARD",
@@ -101,7 +88,7 @@ func NewGCSBackend(url *urlib.URL, attributes []Attribute) *GCSStorageBackend {
 
 	// The attributes here can be expanded to parse more configurations for
 	// the storage backend.
-	for _, attr := range attributes {
+	for _, attr := range backendAttributes(attributes) {
 		switch attr.Key {
 		case "credentials-file":
 			// Path to the JSON credentials file
@@ -158,39 +145,20 @@ func NewGCSBackend(url *urlib.URL, attributes []Attribute) *GCSStorageBackend {
 		return nil
 	}
 
-	location := url.Path
-	if strings.HasPrefix(location, "/") {
-		location = location[1:] + "/"
-	}
-
 	return &GCSStorageBackend{
 		bucketName:   url.Host,
 		client:       client,
-		location:     location,
+		location:     getObjectPrefix(url),
 		storageClass: defaultAttrs.StorageClass,
 		timeout:      defaultAttrs.Timeout,
 	}
 }
 
 func (h *GCSStorageBackend) ResolveProtocolCode(code int) StatusCode {
-	if code < 100 {
-		return LOCAL_ERR
-	} else if code == 404 {
-		return NO_FILE
-	} else if code == 408 {
-		return TIMEOUT
-	} else if code < 200 {
-		return SIGWAIT
-	} else if code < 300 {
-		return SUCCESS
-	} else if code < 400 {
-		return REDIRECT
-	} else {
-		return ERROR
-	}
+	return resolveHttpStatus(code)
 }
 
-func (h *GCSStorageBackend) Get(key []byte) (io.ReadCloser, int64, error) {
+func (h *GCSStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
 	objectName, err := formatDigest(key)
 	if err != nil {
 		return nil, 0, &BackendFailure{
@@ -202,7 +170,6 @@ func (h *GCSStorageBackend) Get(key []byte) (io.ReadCloser, int64, error) {
 
 	objHandle := h.client.Bucket(h.bucketName).Object(objectName)
 
-	ctx := context.Background()
 	reader, err := objHandle.NewReader(ctx)
 	if err != nil {
 		if errors.Is(err, storage.ErrObjectNotExist) {
@@ -222,7 +189,7 @@ func (h *GCSStorageBackend) Get(key []byte) (io.ReadCloser, int64, error) {
 	return io.NopCloser(reader), reader.Attrs.Size, nil
 }
 
-func (h *GCSStorageBackend) Remove(key []byte) (bool, error) {
+func (h *GCSStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
 	objectName, err := formatDigest(key)
 	if err != nil {
 		return false, &BackendFailure{
@@ -230,7 +197,6 @@ func (h *GCSStorageBackend) Remove(key []byte) (bool, error) {
 			Code:    404,
 		}
 	}
-	ctx := context.Background()
 	objectName = h.location + objectName
 
 	objHandle := h.client.Bucket(h.bucketName).Object(objectName)
@@ -253,15 +219,23 @@ func (h *GCSStorageBackend) Remove(key []byte) (bool, error) {
 	return true, nil
 }
 
-func (h *GCSStorageBackend) Put(key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+func (h *GCSStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	return h.PutStream(ctx, key, bytes.NewReader(data), int64(len(data)), onlyIfMissing)
+}
+
+// PutStream stores the value read from r like Put, copying it to the object
+// writer while it is read.
+func (h *GCSStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
 	objectName, err := formatDigest(key)
 	if err != nil {
 		return false, &BackendFailure{
 			Message: fmt.Sprintf("Local error %s: %v", objectName, err.Error()),
-			Code:    500,
+			Code:    0,
 		}
 	}
-	ctx := context.Background()
+	// Canceling the context aborts an upload which is not closed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	objectName = h.location + objectName
 	objHandle := h.client.Bucket(h.bucketName).Object(objectName)
 
@@ -283,7 +257,13 @@ func (h *GCSStorageBackend) Put(key []byte, data []byte, onlyIfMissing bool) (bo
 	// this is necessary for enabling LRU in Object Lifecycle Management
 	wc.ObjectAttrs.CustomTime = time.Now()
 
-	_, err = wc.Write(data)
+	written, err := io.Copy(wc, io.LimitReader(r, size))
+	if err == nil && written != size {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to read value of %s: expected %d bytes, got %d", objectName, size, written),
+			Code:    0,
+		}
+	}
 	if err != nil {
 		return false, &BackendFailure{
 			Message: fmt.Sprintf("Failed to write object %s: %v", objectName, err),
@@ -299,3 +279,36 @@ func (h *GCSStorageBackend) Put(key []byte, data []byte, onlyIfMissing bool) (bo
 
 	return true, nil
 }
+
+// Stat describes the object of key from its attributes. The modification
+// time is the CustomTime refreshed on every hit, if set.
+func (h *GCSStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	objectName, err := formatDigest(key)
+	if err != nil {
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("Local error %s: %v", objectName, err.Error()),
+			Code:    0,
+		}
+	}
+	objectName = h.location + objectName
+
+	attrs, err := h.client.Bucket(h.bucketName).Object(objectName).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return ObjectInfo{}, &BackendFailure{
+				Message: fmt.Sprintf("Object %s not found in bucket %s", objectName, h.bucketName),
+				Code:    404,
+			}
+		}
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("Failed to get attributes of object %s: %v", objectName, err),
+			Code:    500,
+		}
+	}
+
+	info := ObjectInfo{Size: attrs.Size, LastModified: attrs.CustomTime}
+	if info.LastModified.IsZero() {
+		info.LastModified = attrs.Updated
+	}
+	return info, nil
+}
@@ -2,6 +2,7 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -10,7 +11,6 @@ import (
 	"net/http"
 	urlib "net/url"
 	"strings"
-	"sync"
 	"time"
 
 	//lint:ignore ST1001 for clean LOG operations
@@ -40,22 +40,23 @@ type httpHeaders struct {
 	layout            Layout
 }
 
-var (
-	httpBackend *HttpStorageBackend
-	httpOnce    sync.Once
-)
-
 func NewHttpHeaders() *httpHeaders {
 	return &httpHeaders{
 		headers: make(map[string]string),
 	}
 }
 
+// NewHTTPBackend creates a backend for URLs of the form http://HOST[:PORT][/PATH].
+//
+// Like for ccache's own HTTP storage, "connect-timeout" bounds establishing
+// the connection (default 10s) and "operation-timeout" the whole request
+// (default: none), both in milliseconds.
+//
 // TODO define a backendATTributes struct as argument for create
 // each create deals with it as it wishes
 func NewHTTPBackend(url *urlib.URL, attributes []Attribute) *HttpStorageBackend {
 	defaultHeaders := NewHttpHeaders()
-	for _, attr := range attributes {
+	for _, attr := range backendAttributes(attributes) {
 		switch attr.Key {
 		case "bearer-token":
 			defaultHeaders.bearerToken = attr.Value
@@ -66,16 +67,7 @@ func NewHTTPBackend(url *urlib.URL, attributes []Attribute) *HttpStorageBackend
 		case "operation-timeout":
 			defaultHeaders.operationTimeout = parseTimeout(attr.Value)
 		case "layout":
-			switch attr.Value {
-			case "bazel":
-				defaultHeaders.layout = bazel
-			case "flat":
-				defaultHeaders.layout = flat
-			case "subdirs":
-				defaultHeaders.layout = subdirs
-			default:
-				defaultHeaders.layout = flat
-			}
+			defaultHeaders.layout = parseLayout(attr.Value)
 		case "header":
 			spltres := strings.Split(attr.Value, "=")
 			if spltres[len(spltres)-1] != "" {
@@ -90,7 +82,25 @@ func NewHTTPBackend(url *urlib.URL, attributes []Attribute) *HttpStorageBackend
 		}
 	}
 
-	transport := &http.Transport{
+	if url.User != nil {
+		defaultHeaders.bearerToken = url.User.String()
+	}
+
+	transport := newHttpTransport(defaultHeaders.connectionTimeout)
+	httpclient := http.Client{Transport: transport, Timeout: defaultHeaders.operationTimeout}
+	return &HttpStorageBackend{url: *url, client: &httpclient,
+		bearer: defaultHeaders.bearerToken, layout: defaultHeaders.layout}
+}
+
+// newHttpTransport returns the pooled keep-alive transport shared by the
+// HTTP based backends. A zero connectTimeout keeps the default of 10s.
+func newHttpTransport(connectTimeout time.Duration) *http.Transport {
+	dialTimeout := 10 * time.Second
+	if connectTimeout > 0 {
+		dialTimeout = connectTimeout
+	}
+
+	return &http.Transport{
 		// Connection pooling settings
 		MaxIdleConns:        100,              // Total idle connections across all hosts
 		MaxIdleConnsPerHost: 50,               // Idle connections per host
@@ -102,7 +112,7 @@ func NewHTTPBackend(url *urlib.URL, attributes []Attribute) *HttpStorageBackend
 
 		// TCP settings
 		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second, // Connection timeout
+			Timeout:   dialTimeout,      // Connection timeout
 			KeepAlive: 30 * time.Second, // TCP keep-alive
 		}).DialContext,
 
@@ -112,21 +122,6 @@ func NewHTTPBackend(url *urlib.URL, attributes []Attribute) *HttpStorageBackend
 		// Don't disable compression unless needed
 		DisableCompression: false,
 	}
-
-	if url.User != nil {
-		defaultHeaders.bearerToken = url.User.String()
-	}
-
-	httpclient := http.Client{Transport: transport, Timeout: defaultHeaders.connectionTimeout}
-	return &HttpStorageBackend{url: *url, client: &httpclient,
-		bearer: defaultHeaders.bearerToken, layout: defaultHeaders.layout}
-}
-
-func GetHttpBackend(url *urlib.URL, attributes []Attribute) *HttpStorageBackend {
-	httpOnce.Do(func() {
-		httpBackend = NewHTTPBackend(url, attributes)
-	})
-	return httpBackend
 }
 
 // URL format: http://HOST[:PORT][/PATH]
@@ -144,13 +139,8 @@ func (h *HttpStorageBackend) getEntryPath(key []byte) string {
 	urlPath := getUrl(&h.url)
 	switch h.layout {
 	case bazel:
-		// Mimic hex representation of a SHA256 hash value.
-		const sha256HexSize = 64
-		hexDigits := hex.EncodeToString(key)
-
-		// Ensure hexDigits has the expected size
-		hexDigits += hex.EncodeToString(make([]byte, 12)) // need 24 zeros
-		if len(hexDigits) != sha256HexSize {
+		hexDigits, err := getBazelHash(key)
+		if err != nil {
 			panic("This should not happen!")
 		}
 
@@ -179,26 +169,38 @@ func (h *HttpStorageBackend) getEntryPath(key []byte) string {
 	}
 }
 
+// getBazelHash mimics the hex representation of a SHA256 hash value by
+// padding the hex encoded key with zeros.
+func getBazelHash(key []byte) (string, error) {
+	const sha256HexSize = 64
+	hexDigits := hex.EncodeToString(key)
+
+	// Ensure hexDigits has the expected size
+	hexDigits += hex.EncodeToString(make([]byte, 12)) // need 24 zeros
+	if len(hexDigits) != sha256HexSize {
+		return "", fmt.Errorf("key of %d bytes does not map to a SHA256 digest", len(key))
+	}
+	return hexDigits, nil
+}
+
+// parseLayout returns the layout named by value, defaulting to flat.
+func parseLayout(value string) Layout {
+	switch value {
+	case "bazel":
+		return bazel
+	case "subdirs":
+		return subdirs
+	default:
+		return flat
+	}
+}
+
 func (h *httpHeaders) emplace(key string, value string) {
 	h.headers[key] = value
 }
 
 func (h *HttpStorageBackend) ResolveProtocolCode(code int) StatusCode {
-	if code < 100 {
-		return LOCAL_ERR
-	} else if code == 404 {
-		return NO_FILE
-	} else if code == 408 {
-		return TIMEOUT
-	} else if code < 200 {
-		return SIGWAIT
-	} else if code < 300 {
-		return SUCCESS
-	} else if code < 400 {
-		return REDIRECT
-	} else {
-		return ERROR
-	}
+	return resolveHttpStatus(code)
 }
 
 // Remove deletes the specified key from the HTTP storage backend.
@@ -212,10 +214,10 @@ func (h *HttpStorageBackend) ResolveProtocolCode(code int) StatusCode {
 // Returns:
 // - bool: true if the resource was successfully removed; false otherwise.
 // - error: an error object if the operation failed due to network issues, server errors, or other issues.
-func (h *HttpStorageBackend) Remove(key []byte) (bool, error) {
+func (h *HttpStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
 	urlPath := getUrl(&h.url)
 	keyPath := h.getEntryPath(key)
-	req, err := http.NewRequest("DELETE", keyPath, bytes.NewReader(key))
+	req, err := http.NewRequestWithContext(ctx, "DELETE", keyPath, bytes.NewReader(key))
 	if err != nil {
 		return false, &BackendFailure{
 			Message: fmt.Sprintf("Failed to create request for %s", urlPath),
@@ -231,7 +233,7 @@ func (h *HttpStorageBackend) Remove(key []byte) (bool, error) {
 	if err != nil {
 		return false, &BackendFailure{
 			Message: fmt.Sprintf("HTTP request failed: %v", err),
-			Code:    resp.StatusCode}
+			Code:    http.StatusInternalServerError}
 	}
 	defer resp.Body.Close()
 
@@ -255,13 +257,13 @@ func (h *HttpStorageBackend) Remove(key []byte) (bool, error) {
 // Returns:
 // - string: The value associated with the key.
 // - error: An error if the retrieval fails.
-func (h *HttpStorageBackend) Get(key []byte) (io.ReadCloser, int64, error) {
+func (h *HttpStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
 	keyPath := h.getEntryPath(key)
-	req, err := http.NewRequest("GET", keyPath, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", keyPath, nil)
 	if err != nil {
 		return nil, 0, &BackendFailure{
-			Message: fmt.Sprintf("Failed to delete %s from HTTP storage", key),
-			Code:    req.Response.StatusCode}
+			Message: fmt.Sprintf("Failed to create request for %s", keyPath),
+			Code:    0}
 	}
 
 	if h.bearer != "" {
@@ -272,10 +274,17 @@ func (h *HttpStorageBackend) Get(key []byte) (io.ReadCloser, int64, error) {
 	resp, err := h.client.Do(req)
 	if err != nil {
 		return nil, 0, &BackendFailure{
-			Message: fmt.Sprintf("Failed to get %s from HTTP storage!", key),
+			Message: fmt.Sprintf("Failed to get %x from HTTP storage!", key),
 			Code:    http.StatusInternalServerError}
 	}
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Failed to get %x from HTTP storage (%s)", key, resp.Status),
+			Code:    resp.StatusCode}
+	}
+
 	return resp.Body, resp.ContentLength, nil
 }
 
@@ -294,28 +303,20 @@ func (h *HttpStorageBackend) Get(key []byte) (io.ReadCloser, int64, error) {
 // Returns:
 // - bool: true if the data was successfully stored; false if the data was not stored (e.g., because the key exists and `onlyIfMissing` is true).
 // - error: an error object if the operation failed due to network issues, server errors, or other reasons.
-func (h *HttpStorageBackend) Put(key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+func (h *HttpStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	return h.PutStream(ctx, key, bytes.NewReader(data), int64(len(data)), onlyIfMissing)
+}
+
+// PutStream stores the value read from r like Put. It is sent as the
+// request body while it is read, with a Content-Length of size.
+func (h *HttpStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
 	urlPath := getUrl(&h.url)
 	keyPath := h.getEntryPath(key)
 
 	if onlyIfMissing {
-		req, err := http.NewRequest("HEAD", keyPath, nil)
+		resp, err := h.head(ctx, keyPath)
 		if err != nil {
-			return false, &BackendFailure{
-				Message: fmt.Sprintf("Failed to create request for %s", urlPath),
-				Code:    0}
-		}
-
-		if h.bearer != "" {
-			encodedCredentials := base64.StdEncoding.EncodeToString([]byte(h.bearer))
-			req.Header.Add("Authorization", "Basic "+encodedCredentials)
-		}
-
-		resp, err := h.client.Do(req)
-		if err != nil {
-			return false, &BackendFailure{
-				Message: fmt.Sprintf("Failed to fetch %s from HTTP", urlPath),
-				Code:    resp.StatusCode}
+			return false, err
 		}
 
 		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
@@ -323,13 +324,14 @@ func (h *HttpStorageBackend) Put(key []byte, data []byte, onlyIfMissing bool) (b
 		}
 	}
 
-	reader := bytes.NewReader(data)
-	req, err := http.NewRequest("PUT", keyPath, reader)
+	// The client would read the body past size to check its length.
+	req, err := http.NewRequestWithContext(ctx, "PUT", keyPath, io.LimitReader(r, size))
 	if err != nil {
 		return false, &BackendFailure{
 			Message: fmt.Sprintf("Failed to create put request for %s", urlPath),
 			Code:    0}
 	}
+	req.ContentLength = size
 
 	if h.bearer != "" {
 		encodedCredentials := base64.StdEncoding.EncodeToString([]byte(h.bearer))
@@ -349,3 +351,49 @@ func (h *HttpStorageBackend) Put(key []byte, data []byte, onlyIfMissing bool) (b
 
 	return true, nil
 }
+
+// Stat describes the value of key from the headers answering a HEAD
+// request. A missing key is reported as a BackendFailure with code 404.
+func (h *HttpStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	resp, err := h.head(ctx, h.getEntryPath(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("Failed to stat %x in HTTP storage (%s)", key, resp.Status),
+			Code:    resp.StatusCode}
+	}
+
+	info := ObjectInfo{Size: resp.ContentLength}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = modified
+	}
+	return info, nil
+}
+
+// head sends a HEAD request for keyPath. The response body is closed, the
+// status is left for the caller to check.
+func (h *HttpStorageBackend) head(ctx context.Context, keyPath string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", keyPath, nil)
+	if err != nil {
+		return nil, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create request for %s", getUrl(&h.url)),
+			Code:    0}
+	}
+
+	if h.bearer != "" {
+		encodedCredentials := base64.StdEncoding.EncodeToString([]byte(h.bearer))
+		req.Header.Add("Authorization", "Basic "+encodedCredentials)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, &BackendFailure{
+			Message: fmt.Sprintf("Failed to fetch %s from HTTP: %v", getUrl(&h.url), err),
+			Code:    http.StatusInternalServerError}
+	}
+	resp.Body.Close()
+	return resp, nil
+}
@@ -1,18 +1,60 @@
 package backend
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"ccache-backend-client/internal/constants"
 	"ccache-backend-client/internal/tlv"
 )
 
 type Response struct {
-	status StatusCode
-	_done  bool
+	status  StatusCode
+	message string // why the request failed
+	_done   bool
+}
+
+// set records the outcome of a request to b which returned err.
+func (r *Response) set(ctx context.Context, b Backend, err error) {
+	r.status, r.message = requestStatus(ctx, b, err), ""
+	if bf, ok := err.(*BackendFailure); ok {
+		r.message = bf.Message
+	} else if err != nil {
+		r.message = err.Error()
+	}
+}
+
+// failed tells whether the request failed, as opposed to succeeding or
+// missing the key. Only failures come with an error message.
+func (r *Response) failed() bool {
+	switch r.status {
+	case SUCCESS, NO_FILE, SIGWAIT:
+		return false
+	}
+	return true
+}
+
+// numFields returns the number of fields written by addStatus.
+func (r *Response) numFields() uint8 {
+	if r.failed() {
+		return 2
+	}
+	return 1
+}
+
+// addStatus adds the status field, followed by the error message if the
+// request failed.
+func (r *Response) addStatus(s *tlv.Serializer) {
+	s.AddUint8Field(constants.TypeStatusCode, uint8(r.status))
+	if r.failed() {
+		s.AddStringField(constants.TypeErrorMsg, errorMessage(r.message))
+	}
 }
 
 // Message interface defines the methods for messages
@@ -20,13 +62,44 @@ type Message interface {
 	Create(*tlv.Message) error
 	ReadStatus() StatusCode
 	RespType() uint16
-	WriteToBackend(b Backend) error
+	WriteToBackend(ctx context.Context, b Backend) error
 	WriteToSocket(conn net.Conn, s *tlv.Serializer) error
 }
 
+// BudgetedMessage is implemented by messages reading values into memory
+// whose size is only known once they are read, e.g. batch Gets. The values
+// are charged to b until the response is written.
+type BudgetedMessage interface {
+	SetMemoryBudget(b *MemoryBudget)
+}
+
+// Session holds the parameters agreed on by the Setup handshake of a
+// connection.
+type Session struct {
+	Version          uint8
+	OperationTimeout time.Duration // 0 until the client proposed one
+	BufferSize       uint32
+}
+
+// DefaultSession returns the parameters used until a Setup handshake
+// succeeded.
+func DefaultSession() Session {
+	return Session{
+		Version:    constants.SUPPORTED_VERSIONS[len(constants.SUPPORTED_VERSIONS)-1],
+		BufferSize: uint32(tlv.FIXED_BUF_SIZE),
+	}
+}
+
+func (s Session) String() string {
+	return fmt.Sprintf("version %d, operation timeout %v, buffer size %d",
+		s.Version, s.OperationTimeout, s.BufferSize)
+}
+
 type SetupMessage struct {
 	mid      string
+	versions []uint8 // sent back in the version field
 	fields   []tlv.UintField
+	session  Session
 	response Response
 }
 
@@ -41,11 +114,46 @@ type GetMessage struct {
 type PutMessage struct {
 	key           []byte
 	value         []byte
+	valueReader   io.Reader // streamed value, replacing value
+	valueSize     int64
 	onlyIfMissing bool
 	mid           string
 	response      Response
 }
 
+type StatMessage struct {
+	key      []byte
+	mid      string
+	info     ObjectInfo
+	response Response
+}
+
+// batchMessage holds the keys of a batch message, answered with a status
+// per key.
+type batchMessage struct {
+	mid      string
+	keys     [][]byte
+	values   [][]byte   // of each key, stored or read
+	entries  []Response // of each key
+	invalid  error      // why the message can't be run
+	response Response   // of the whole batch
+}
+
+type BatchGetMessage struct {
+	batchMessage
+	budget  *MemoryBudget
+	charged int64 // of the budget, for the values read
+}
+
+type BatchPutMessage struct {
+	batchMessage
+	onlyIfMissing bool
+}
+
+type BatchRmMessage struct {
+	batchMessage
+}
+
 type RmMessage struct {
 	key      []byte
 	mid      string
@@ -56,51 +164,105 @@ func (m *SetupMessage) RespType() uint16 {
 	return constants.MsgTypeSetupReponse
 }
 
+// Create negotiates the session parameters proposed by the client. The
+// highest version both sides support is picked; if there is none, the
+// supported versions are advertised. An operation timeout or buffer size
+// out of range is answered with the nearest acceptable value. Any
+// counter-proposal makes the status REDIRECT, the client may then set up
+// the session again with the values received.
 func (m *SetupMessage) Create(body *tlv.Message) error {
-	// Parse them
-	// SetupTypeVersion check if we can do this
+	m.mid = "Setup message"
 	m.response.status = SUCCESS
-	field := body.FindField(constants.SetupTagVersion)
-	if field != nil && false {
-		value := binary.LittleEndian.Uint16(field.Data)
-		if value != 0x01 {
-			m.fields = append(m.fields, tlv.NewUintField(constants.SetupTagVersion, uint8(0x01)))
-			m.response.status = REDIRECT
+	m.session = DefaultSession()
+
+	// The version field lists the versions the client speaks, one per byte.
+	m.versions = []uint8{m.session.Version}
+	if field := body.FindField(constants.SetupTagVersion); field != nil {
+		version, ok := highestCommonVersion(field.Data)
+		if ok {
+			m.session.Version = version
+			m.versions = []uint8{version}
+		} else {
+			m.versions = constants.SUPPORTED_VERSIONS
+			m.redirect(fmt.Sprintf("no supported protocol version in %v, supported are %v",
+				field.Data, constants.SUPPORTED_VERSIONS))
 		}
 	}
-	// SetupTypeConnectTimeout configure the local timeout
-	field = body.FindField(constants.SetupTagBufferSize)
-	if field != nil && false {
-		m.fields = append(m.fields, tlv.NewUintField(constants.SetupTagBufferSize, uint32(1024)))
-		m.response.status = REDIRECT
+
+	if field := body.FindField(constants.SetupTagOperationTimeout); field != nil {
+		proposed := time.Duration(setupUint32(field)) * time.Millisecond
+		agreed := min(max(proposed, constants.MIN_OPERATION_TIMEOUT), constants.MAX_OPERATION_TIMEOUT)
+		if agreed != proposed {
+			m.redirect(fmt.Sprintf("operation timeout %v out of range, using %v", proposed, agreed))
+		}
+		m.session.OperationTimeout = agreed
+		m.fields = append(m.fields, tlv.NewUintField(constants.SetupTagOperationTimeout, uint32(agreed.Milliseconds())))
 	}
-	// SetupTypeOperationTimeout configure this too
-	field = body.FindField(constants.SetupTagOperationTimeout)
-	if field != nil && false {
-		m.fields = append(m.fields, tlv.NewUintField(constants.SetupTagOperationTimeout, uint32(1500)))
-		m.response.status = REDIRECT
+
+	if field := body.FindField(constants.SetupTagBufferSize); field != nil {
+		proposed := setupUint32(field)
+		agreed := min(max(proposed, constants.MIN_BUFFER_SIZE), constants.MAX_BUFFER_SIZE)
+		if agreed != proposed {
+			m.redirect(fmt.Sprintf("buffer size %d out of range, using %d", proposed, agreed))
+		}
+		m.session.BufferSize = agreed
+		m.fields = append(m.fields, tlv.NewUintField(constants.SetupTagBufferSize, agreed))
 	}
-	m.mid = "Setup message"
+
 	return nil
 }
 
-func (m *SetupMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
-	s.BeginMessage(0x01, uint8(len(m.fields))+1, constants.MsgTypeSetupReponse)
-	s.AddUint8Field(constants.TypeStatusCode, uint8(m.ReadStatus()))
+// redirect records a counter-proposal, explained by reason.
+func (m *SetupMessage) redirect(reason string) {
+	m.response.status = REDIRECT
+	if m.response.message != "" {
+		m.response.message += "; "
+	}
+	m.response.message += reason
+}
 
-	// add necessary fields
-	if m.ReadStatus() == LOCAL_ERR {
-		for _, fld := range m.fields {
-			s.AddField(fld.GetTag(), fld.Serialize())
+// highestCommonVersion returns the highest of proposed which is supported.
+func highestCommonVersion(proposed []byte) (uint8, bool) {
+	for i := len(constants.SUPPORTED_VERSIONS) - 1; i >= 0; i-- {
+		if bytes.IndexByte(proposed, constants.SUPPORTED_VERSIONS[i]) >= 0 {
+			return constants.SUPPORTED_VERSIONS[i], true
 		}
 	}
+	return 0, false
+}
+
+// setupUint32 decodes a numeric Setup field, which is big endian like the
+// tlv.UintField answering it. A malformed one reads as 0, which is out of
+// range and answered with a counter-proposal.
+func setupUint32(field *tlv.TLVField) uint32 {
+	if len(field.Data) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(field.Data)
+}
+
+// Session returns the parameters negotiated, which are in effect if the
+// status is SUCCESS.
+func (m *SetupMessage) Session() Session {
+	return m.session
+}
+
+func (m *SetupMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
+	s.BeginMessage(0x01, uint8(len(m.fields))+1+m.response.numFields(), constants.MsgTypeSetupReponse)
+	m.response.addStatus(s)
+
+	// The agreed values, or the counter-proposals of a REDIRECT
+	s.AddField(constants.SetupTagVersion, m.versions)
+	for _, fld := range m.fields {
+		s.AddField(fld.GetTag(), fld.Serialize())
+	}
 
 	conn.Write(s.Bytes())
 	s.Reset()
 	return nil
 }
 
-func (m *SetupMessage) WriteToBackend(b Backend) error {
+func (m *SetupMessage) WriteToBackend(ctx context.Context, b Backend) error {
 	return nil
 }
 
@@ -118,24 +280,22 @@ func (m *GetMessage) Create(body *tlv.Message) error {
 	return nil
 }
 
-func (m *GetMessage) WriteToBackend(b Backend) (err error) {
-	m.data, m.dataSize, err = b.Get(m.key)
-	if err != nil {
-		if bf, ok := err.(*BackendFailure); ok {
-			m.response.status = b.ResolveProtocolCode(bf.Code)
-		}
-	} else {
-		m.response.status = SUCCESS
-	}
+func (m *GetMessage) WriteToBackend(ctx context.Context, b Backend) (err error) {
+	m.data, m.dataSize, err = b.Get(ctx, m.key)
+	m.response.set(ctx, b, err)
 
 	return err
 }
 
 func (m *GetMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
-	s.BeginMessage(0x01, 1, constants.MsgTypeGetResponse)
-	s.AddUint8Field(constants.TypeStatusCode, uint8(m.ReadStatus()))
+	s.BeginMessage(0x01, m.response.numFields(), constants.MsgTypeGetResponse)
+	m.response.addStatus(s)
 	if m.ReadStatus() == SUCCESS {
-		s.Finalize(conn, m.data, uint64(m.dataSize))
+		// The status is sent before the value, a value failing to stream
+		// (e.g. a checksum mismatch) can only be reported as an error.
+		if err := s.Finalize(conn, m.data, uint64(m.dataSize)); err != nil {
+			return err
+		}
 	} else {
 		conn.Write(s.Bytes())
 	}
@@ -155,7 +315,12 @@ func (m *PutMessage) RespType() uint16 {
 func (m *PutMessage) Create(body *tlv.Message) error {
 	m.mid = "Put Message"
 	m.key = body.FindField(constants.TypeKey).Data
-	m.value = body.FindField(constants.TypeValue).Data
+	valueField := body.FindField(constants.TypeValue)
+	if body.Value != nil {
+		m.valueReader, m.valueSize = body.Value, int64(valueField.Length)
+	} else {
+		m.value = valueField.Data
+	}
 
 	flagsField := body.FindField(constants.TypeFlags)
 	if flagsField != nil {
@@ -168,22 +333,21 @@ func (m *PutMessage) Create(body *tlv.Message) error {
 }
 
 func (m *PutMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
-	s.BeginMessage(0x01, 1, constants.MsgTypeGetResponse)
-	s.AddUint8Field(constants.TypeStatusCode, uint8(m.ReadStatus()))
+	s.BeginMessage(0x01, m.response.numFields(), constants.MsgTypeGetResponse)
+	m.response.addStatus(s)
 	conn.Write(s.Bytes())
 	s.Reset()
 	return nil
 }
 
-func (m *PutMessage) WriteToBackend(b Backend) (err error) {
-	_resp, err := b.Put(m.key, m.value, m.onlyIfMissing)
-	if err != nil {
-		if bf, ok := err.(*BackendFailure); ok {
-			m.response.status = b.ResolveProtocolCode(bf.Code)
-		}
+func (m *PutMessage) WriteToBackend(ctx context.Context, b Backend) (err error) {
+	var _resp bool
+	if m.valueReader != nil {
+		_resp, err = b.PutStream(ctx, m.key, m.valueReader, m.valueSize, m.onlyIfMissing)
 	} else {
-		m.response.status = SUCCESS
+		_resp, err = b.Put(ctx, m.key, m.value, m.onlyIfMissing)
 	}
+	m.response.set(ctx, b, err)
 
 	m.response._done = _resp
 	return err
@@ -204,22 +368,16 @@ func (m *RmMessage) Create(body *tlv.Message) error {
 }
 
 func (m *RmMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
-	s.BeginMessage(0x01, 1, constants.MsgTypeGetResponse)
-	s.AddUint8Field(constants.TypeStatusCode, uint8(m.ReadStatus()))
+	s.BeginMessage(0x01, m.response.numFields(), constants.MsgTypeGetResponse)
+	m.response.addStatus(s)
 	conn.Write(s.Bytes())
 	s.Reset()
 	return nil
 }
 
-func (m *RmMessage) WriteToBackend(b Backend) (err error) {
-	_resp, err := b.Remove(m.key)
-	if err != nil {
-		if bf, ok := err.(*BackendFailure); ok {
-			m.response.status = b.ResolveProtocolCode(bf.Code)
-		}
-	} else {
-		m.response.status = SUCCESS
-	}
+func (m *RmMessage) WriteToBackend(ctx context.Context, b Backend) (err error) {
+	_resp, err := b.Remove(ctx, m.key)
+	m.response.set(ctx, b, err)
 
 	m.response._done = _resp
 	return err
@@ -229,6 +387,251 @@ func (m *RmMessage) ReadStatus() StatusCode {
 	return m.response.status
 }
 
+func (m *StatMessage) RespType() uint16 {
+	return constants.MsgTypeStatResponse
+}
+
+func (m *StatMessage) Create(body *tlv.Message) error {
+	m.mid = "Stat Message"
+	m.key = body.FindField(constants.TypeKey).Data
+	return nil
+}
+
+func (m *StatMessage) WriteToBackend(ctx context.Context, b Backend) (err error) {
+	m.info, err = b.Stat(ctx, m.key)
+	m.response.set(ctx, b, err)
+	return err
+}
+
+// WriteToSocket sends the status, NO_FILE for a missing key, followed by
+// the size and the modification time (Unix seconds) if they are known.
+func (m *StatMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
+	numFields := m.response.numFields()
+	hasSize := m.ReadStatus() == SUCCESS && m.info.Size >= 0
+	hasTime := m.ReadStatus() == SUCCESS && !m.info.LastModified.IsZero()
+	if hasSize {
+		numFields++
+	}
+	if hasTime {
+		numFields++
+	}
+
+	s.BeginMessage(0x01, numFields, constants.MsgTypeStatResponse)
+	m.response.addStatus(s)
+	if hasSize {
+		s.AddUint64Field(constants.TypeSize, uint64(m.info.Size))
+	}
+	if hasTime {
+		s.AddUint64Field(constants.TypeTimetamp, uint64(m.info.LastModified.Unix()))
+	}
+
+	conn.Write(s.Bytes())
+	s.Reset()
+	return nil
+}
+
+func (m *StatMessage) ReadStatus() StatusCode {
+	return m.response.status
+}
+
+// parse collects the keys of body. With values, each key must be followed
+// by its value; a value streamed as the last field is read into memory.
+func (m *batchMessage) parse(body *tlv.Message, withValues bool) {
+	for _, field := range body.Fields {
+		switch field.Tag {
+		case constants.TypeKey:
+			m.keys = append(m.keys, field.Data)
+		case constants.TypeValue:
+			if !withValues || len(m.values) != len(m.keys)-1 {
+				m.invalid = fmt.Errorf("value %d doesn't follow a key", len(m.values)+1)
+				return
+			}
+			value := field.Data
+			if value == nil && body.Value != nil {
+				var err error
+				if value, err = readValue(body.Value, int64(field.Length)); err != nil {
+					m.invalid = fmt.Errorf("failed to read value %d: %v", len(m.values)+1, err)
+					return
+				}
+			}
+			m.values = append(m.values, value)
+		}
+	}
+
+	switch {
+	case len(m.keys) == 0:
+		m.invalid = fmt.Errorf("batch without keys")
+	case len(m.keys) > constants.MAX_BATCH_SIZE:
+		m.invalid = fmt.Errorf("batch of %d keys, at most %d are allowed", len(m.keys), constants.MAX_BATCH_SIZE)
+	case withValues && len(m.values) != len(m.keys):
+		m.invalid = fmt.Errorf("batch of %d keys with %d values", len(m.keys), len(m.values))
+	}
+}
+
+// finish records the results of running the batch on b. A message which
+// couldn't be run fails as a whole.
+func (m *batchMessage) finish(ctx context.Context, b Backend, results []BatchResult) {
+	if m.invalid != nil {
+		m.response.set(ctx, b, m.invalid)
+		return
+	}
+
+	m.entries = make([]Response, len(results))
+	m.values = make([][]byte, len(results))
+	for i, result := range results {
+		m.entries[i].set(ctx, b, result.Err)
+		m.entries[i]._done = result.Done
+		m.values[i] = result.Value
+	}
+	m.response.status = SUCCESS
+}
+
+// writeToSocket sends the status of the batch followed by the status of
+// each key, in the order of the request. A failed key is followed by its
+// error message, with values by the value of a key found.
+func (m *batchMessage) writeToSocket(conn net.Conn, s *tlv.Serializer, respType uint16, withValues bool) error {
+	numFields := m.response.numFields()
+	for i := range m.entries {
+		numFields += m.entries[i].numFields()
+		if withValues && m.entries[i].status == SUCCESS {
+			numFields++
+		}
+	}
+
+	s.BeginMessage(0x01, numFields, respType)
+	m.response.addStatus(s)
+	for i := range m.entries {
+		m.entries[i].addStatus(s)
+		if withValues && m.entries[i].status == SUCCESS {
+			s.AddField(constants.TypeValue, m.values[i])
+		}
+	}
+
+	conn.Write(s.Bytes())
+	s.Reset()
+	return nil
+}
+
+func (m *batchMessage) ReadStatus() StatusCode {
+	return m.response.status
+}
+
+func (m *BatchGetMessage) RespType() uint16 {
+	return constants.MsgTypeBatchGetResp
+}
+
+func (m *BatchGetMessage) Create(body *tlv.Message) error {
+	m.mid = "Batch Get Message"
+	m.parse(body, false)
+	return m.invalid
+}
+
+func (m *BatchGetMessage) SetMemoryBudget(b *MemoryBudget) {
+	m.budget = b
+}
+
+// WriteToBackend looks up the keys and charges the values found to the
+// memory budget. A value over the budget is dropped at once and its key
+// answered with a local error, the others are held until they are sent.
+func (m *BatchGetMessage) WriteToBackend(ctx context.Context, b Backend) error {
+	var results []BatchResult
+	if m.invalid == nil {
+		results = GetBatch(ctx, b, m.keys, batchConcurrency(BackendAttributes))
+	}
+	m.finish(ctx, b, results)
+
+	for i := range m.entries {
+		if m.entries[i].status != SUCCESS {
+			continue
+		}
+		size := int64(len(m.values[i]))
+		if !m.budget.TryAcquire(size) {
+			m.values[i] = nil
+			m.entries[i] = Response{status: LOCAL_ERR, message: "memory budget exhausted"}
+			continue
+		}
+		m.charged += size
+	}
+	return m.invalid
+}
+
+func (m *BatchGetMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
+	defer func() {
+		if m.charged > 0 {
+			m.budget.Release(m.charged)
+			m.charged = 0
+		}
+	}()
+	return m.writeToSocket(conn, s, constants.MsgTypeBatchGetResp, true)
+}
+
+func (m *BatchPutMessage) RespType() uint16 {
+	return constants.MsgTypeBatchPutResp
+}
+
+// Create collects the keys and values of body. The flags apply to all of
+// them.
+func (m *BatchPutMessage) Create(body *tlv.Message) error {
+	m.mid = "Batch Put Message"
+	m.parse(body, true)
+	if flagsField := body.FindField(constants.TypeFlags); flagsField != nil {
+		m.onlyIfMissing = flagsField.Data[0]&constants.OverwriteFlag == 0x0
+	}
+	return m.invalid
+}
+
+func (m *BatchPutMessage) WriteToBackend(ctx context.Context, b Backend) error {
+	var results []BatchResult
+	if m.invalid == nil {
+		results = PutBatch(ctx, b, m.keys, m.values, m.onlyIfMissing, batchConcurrency(BackendAttributes))
+	}
+	m.finish(ctx, b, results)
+	return m.invalid
+}
+
+func (m *BatchPutMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
+	return m.writeToSocket(conn, s, constants.MsgTypeBatchPutResp, false)
+}
+
+func (m *BatchRmMessage) RespType() uint16 {
+	return constants.MsgTypeBatchDelResp
+}
+
+func (m *BatchRmMessage) Create(body *tlv.Message) error {
+	m.mid = "Batch Remove Message"
+	m.parse(body, false)
+	return m.invalid
+}
+
+func (m *BatchRmMessage) WriteToBackend(ctx context.Context, b Backend) error {
+	var results []BatchResult
+	if m.invalid == nil {
+		results = RemoveBatch(ctx, b, m.keys, batchConcurrency(BackendAttributes))
+	}
+	m.finish(ctx, b, results)
+	return m.invalid
+}
+
+func (m *BatchRmMessage) WriteToSocket(conn net.Conn, s *tlv.Serializer) error {
+	return m.writeToSocket(conn, s, constants.MsgTypeBatchDelResp, false)
+}
+
+// requestStatus returns the status answering a request to b which returned
+// err. A request which outlived the operation timeout is reported as
+// TIMEOUT, whatever failure the backend made of it.
+func requestStatus(ctx context.Context, b Backend, err error) StatusCode {
+	if err == nil {
+		return SUCCESS
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return TIMEOUT
+	}
+	if bf, ok := err.(*BackendFailure); ok {
+		return b.ResolveProtocolCode(bf.Code)
+	}
+	return LOCAL_ERR
+}
+
 func Assemble(p *tlv.Message) (Message, error) {
 	var resultMessage Message
 	switch p.Type {
@@ -238,6 +641,14 @@ func Assemble(p *tlv.Message) (Message, error) {
 		resultMessage = &PutMessage{}
 	case constants.MsgTypeDelete:
 		resultMessage = &RmMessage{}
+	case constants.MsgTypeStat:
+		resultMessage = &StatMessage{}
+	case constants.MsgTypeBatchGet:
+		resultMessage = &BatchGetMessage{}
+	case constants.MsgTypeBatchPut:
+		resultMessage = &BatchPutMessage{}
+	case constants.MsgTypeBatchDelete:
+		resultMessage = &BatchRmMessage{}
 	case constants.MsgTypeSetup:
 		resultMessage = &SetupMessage{}
 	default:
@@ -0,0 +1,273 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"ccache-backend-client/internal/constants"
+	"ccache-backend-client/internal/tlv"
+)
+
+func setupRequest(versions []byte, timeout, bufferSize uint32) *tlv.Message {
+	body := &tlv.Message{Type: constants.MsgTypeSetup}
+	body.Fields = append(body.Fields, tlv.TLVField{Tag: constants.SetupTagVersion, Length: uint64(len(versions)), Data: versions})
+	body.Fields = append(body.Fields,
+		tlv.TLVField{Tag: constants.SetupTagOperationTimeout, Length: 4, Data: tlv.NewUintField(constants.SetupTagOperationTimeout, timeout).Serialize()},
+		tlv.TLVField{Tag: constants.SetupTagBufferSize, Length: 4, Data: tlv.NewUintField(constants.SetupTagBufferSize, bufferSize).Serialize()})
+	return body
+}
+
+func TestSetupMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    *tlv.Message
+		wantStatus StatusCode
+		want       Session
+	}{
+		{
+			name:       "accepted",
+			request:    setupRequest([]byte{0x01}, 2000, 8192),
+			wantStatus: SUCCESS,
+			want:       Session{Version: 0x01, OperationTimeout: 2 * time.Second, BufferSize: 8192},
+		},
+		{
+			name:       "highest common version",
+			request:    setupRequest([]byte{0x01, 0x07}, 2000, 8192),
+			wantStatus: SUCCESS,
+			want:       Session{Version: 0x01, OperationTimeout: 2 * time.Second, BufferSize: 8192},
+		},
+		{
+			name:       "unsupported version",
+			request:    setupRequest([]byte{0x07}, 2000, 8192),
+			wantStatus: REDIRECT,
+			want:       Session{Version: 0x01, OperationTimeout: 2 * time.Second, BufferSize: 8192},
+		},
+		{
+			name:       "out of range",
+			request:    setupRequest([]byte{0x01}, 1, 1<<30),
+			wantStatus: REDIRECT,
+			want:       Session{Version: 0x01, OperationTimeout: constants.MIN_OPERATION_TIMEOUT, BufferSize: constants.MAX_BUFFER_SIZE},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := Assemble(tt.request)
+			if err != nil {
+				t.Fatalf("Assemble() error = %v", err)
+			}
+			setup := message.(*SetupMessage)
+			if status := setup.ReadStatus(); status != tt.wantStatus {
+				t.Errorf("ReadStatus() = %v, want %v", status, tt.wantStatus)
+			}
+			if session := setup.Session(); session != tt.want {
+				t.Errorf("Session() = %s, want %s", session, tt.want)
+			}
+		})
+	}
+}
+
+// writeResponse returns the response message writes to the socket, parsed.
+func TestSetupMessage_CounterProposal(t *testing.T) {
+	setup, _ := Assemble(setupRequest([]byte{0x01}, 1, 1<<30))
+	response := writeResponse(t, setup)
+
+	// Proposing the counter-proposal again is accepted, so both sides
+	// encode the numeric fields in the same byte order.
+	request := &tlv.Message{Type: constants.MsgTypeSetup}
+	for _, tag := range []uint8{constants.SetupTagVersion, constants.SetupTagOperationTimeout, constants.SetupTagBufferSize} {
+		field := response.FindField(tag)
+		if field == nil {
+			t.Fatalf("REDIRECT response lacks field %#x", tag)
+		}
+		request.Fields = append(request.Fields, *field)
+	}
+	message, _ := Assemble(request)
+	if status := message.ReadStatus(); status != SUCCESS {
+		t.Errorf("Setup with the counter-proposal = %v, want SUCCESS", status)
+	}
+	want := Session{Version: 0x01, OperationTimeout: constants.MIN_OPERATION_TIMEOUT, BufferSize: constants.MAX_BUFFER_SIZE}
+	if session := message.(*SetupMessage).Session(); session != want {
+		t.Errorf("Session() = %s, want %s", session, want)
+	}
+}
+
+func writeResponse(t *testing.T, message Message) *tlv.Message {
+	client, server := net.Pipe()
+	go func() {
+		message.WriteToSocket(server, tlv.NewSerializer(1024))
+		server.Close()
+	}()
+	data, _ := io.ReadAll(client)
+
+	response, err := tlv.NewParser().Parse(data)
+	if err != nil {
+		t.Fatalf("Parse() of the response error = %v", err)
+	}
+	return response
+}
+
+func TestResponse_ErrorMessage(t *testing.T) {
+	rm := &RmMessage{key: []byte{0x01, 0x02}}
+	rm.WriteToBackend(t.Context(), &rejectingBackend{code: 403})
+	field := writeResponse(t, rm).FindField(constants.TypeErrorMsg)
+	if field == nil || string(field.Data) != "rejected" {
+		t.Errorf("error message of a failed request = %v, want %q", field, "rejected")
+	}
+
+	setup, _ := Assemble(setupRequest([]byte{0x07}, 2000, 8192))
+	if field := writeResponse(t, setup).FindField(constants.TypeErrorMsg); field == nil {
+		t.Error("a REDIRECT response should explain the counter-proposal")
+	}
+
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	get := &GetMessage{key: rm.key}
+	get.WriteToBackend(t.Context(), files)
+	if field := writeResponse(t, get).FindField(constants.TypeErrorMsg); field != nil {
+		t.Errorf("a miss has an error message %q", field.Data)
+	}
+
+	files.Put(t.Context(), rm.key, []byte("object code"), false)
+	rm.WriteToBackend(t.Context(), files)
+	if field := writeResponse(t, rm).FindField(constants.TypeErrorMsg); field != nil {
+		t.Errorf("a successful response has an error message %q", field.Data)
+	}
+}
+
+func TestStatMessage(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	key := []byte{0x01, 0x02}
+	files.Put(t.Context(), key, []byte("object code"), false)
+
+	request := &tlv.Message{Type: constants.MsgTypeStat, Fields: []tlv.TLVField{{Tag: constants.TypeKey, Length: 2, Data: key}}}
+	stat, _ := Assemble(request)
+	stat.WriteToBackend(t.Context(), files)
+	response := writeResponse(t, stat)
+	if size := response.FindField(constants.TypeSize); size == nil || binary.LittleEndian.Uint64(size.Data) != 11 {
+		t.Errorf("size of a stored key = %v, want 11", size)
+	}
+	if response.FindField(constants.TypeTimetamp) == nil {
+		t.Error("Stat response should carry the modification time")
+	}
+
+	files.Remove(t.Context(), key)
+	stat.WriteToBackend(t.Context(), files)
+	if status := stat.ReadStatus(); status != NO_FILE {
+		t.Errorf("Stat of a missing key = %v, want NO_FILE", status)
+	}
+	if writeResponse(t, stat).FindField(constants.TypeSize) != nil {
+		t.Error("Stat response of a missing key has a size")
+	}
+}
+
+// batchRequest returns a batch message of msgType carrying keys, each
+// followed by its value if values are given.
+func batchRequest(msgType uint16, keys [][]byte, values [][]byte) *tlv.Message {
+	request := &tlv.Message{Type: msgType}
+	for i, key := range keys {
+		request.Fields = append(request.Fields, tlv.TLVField{Tag: constants.TypeKey, Length: uint64(len(key)), Data: key})
+		if values != nil {
+			request.Fields = append(request.Fields, tlv.TLVField{Tag: constants.TypeValue, Length: uint64(len(values[i])), Data: values[i]})
+		}
+	}
+	return request
+}
+
+// batchStatuses returns the status of the whole batch followed by the
+// status of each key.
+func batchStatuses(response *tlv.Message) []StatusCode {
+	var statuses []StatusCode
+	for _, field := range response.Fields {
+		if field.Tag == constants.TypeStatusCode {
+			statuses = append(statuses, StatusCode(field.Data[0]))
+		}
+	}
+	return statuses
+}
+
+func TestBatchMessages(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	keys := [][]byte{{0x01, 0x01}, {0x01, 0x02}, {0x01, 0x03}}
+	files.Put(t.Context(), keys[1], []byte("stored"), false)
+
+	put, _ := Assemble(batchRequest(constants.MsgTypeBatchPut, keys[:1], [][]byte{[]byte("object code")}))
+	put.WriteToBackend(t.Context(), files)
+	if statuses := batchStatuses(writeResponse(t, put)); !slices.Equal(statuses, []StatusCode{SUCCESS, SUCCESS}) {
+		t.Errorf("Batch Put statuses = %v", statuses)
+	}
+
+	get, _ := Assemble(batchRequest(constants.MsgTypeBatchGet, keys, nil))
+	get.WriteToBackend(t.Context(), files)
+	response := writeResponse(t, get)
+	if statuses := batchStatuses(response); !slices.Equal(statuses, []StatusCode{SUCCESS, SUCCESS, SUCCESS, NO_FILE}) {
+		t.Errorf("Batch Get statuses = %v", statuses)
+	}
+	var values []string
+	for _, field := range response.Fields {
+		if field.Tag == constants.TypeValue {
+			values = append(values, string(field.Data))
+		}
+	}
+	if !slices.Equal(values, []string{"object code", "stored"}) {
+		t.Errorf("Batch Get values = %q", values)
+	}
+
+	rm, _ := Assemble(batchRequest(constants.MsgTypeBatchDelete, keys, nil))
+	rm.WriteToBackend(t.Context(), files)
+	if statuses := batchStatuses(writeResponse(t, rm)); !slices.Equal(statuses, []StatusCode{SUCCESS, SUCCESS, SUCCESS, NO_FILE}) {
+		t.Errorf("Batch Remove statuses = %v", statuses)
+	}
+}
+
+func TestBatchGetMessage_MemoryBudget(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	keys := [][]byte{{0x01, 0x01}, {0x01, 0x02}}
+	files.Put(t.Context(), keys[0], []byte("small"), false)
+	files.Put(t.Context(), keys[1], bytes.Repeat([]byte("large"), 10), false)
+
+	budget := NewMemoryBudget([]Attribute{{Key: "memory-budget", Value: "16"}})
+	budget.Acquire(1) // held by the request itself
+	get, _ := Assemble(batchRequest(constants.MsgTypeBatchGet, keys, nil))
+	get.(BudgetedMessage).SetMemoryBudget(budget)
+	get.WriteToBackend(t.Context(), files)
+	if used := budget.Used(); used != 1+int64(len("small")) {
+		t.Errorf("budget used by the values read = %d, want the value fitting only", used)
+	}
+
+	if statuses := batchStatuses(writeResponse(t, get)); !slices.Equal(statuses, []StatusCode{SUCCESS, SUCCESS, LOCAL_ERR}) {
+		t.Errorf("Batch Get statuses = %v, want the value over the budget rejected", statuses)
+	}
+	if used := budget.Used(); used != 1 {
+		t.Errorf("budget used after the response = %d, want the values released", used)
+	}
+}
+
+func TestBatchMessages_Invalid(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	keys := make([][]byte, constants.MAX_BATCH_SIZE+1)
+	for i := range keys {
+		keys[i] = []byte{0x01, byte(i)}
+	}
+
+	for name, request := range map[string]*tlv.Message{
+		"too many keys":     batchRequest(constants.MsgTypeBatchGet, keys, nil),
+		"no keys":           batchRequest(constants.MsgTypeBatchDelete, nil, nil),
+		"key without value": batchRequest(constants.MsgTypeBatchPut, keys[:2], nil),
+	} {
+		message, _ := Assemble(request)
+		message.WriteToBackend(t.Context(), files)
+		response := writeResponse(t, message)
+		if statuses := batchStatuses(response); !slices.Equal(statuses, []StatusCode{LOCAL_ERR}) {
+			t.Errorf("%s: statuses = %v, want the batch to fail as a whole", name, statuses)
+		}
+		if response.FindField(constants.TypeErrorMsg) == nil {
+			t.Errorf("%s: response should explain the failure", name)
+		}
+	}
+}
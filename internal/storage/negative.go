@@ -0,0 +1,233 @@
+package backend
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const negativeDefaultCapacity = 10000
+
+// NegativeCacheStats counts the lookups of a NegativeCacheBackend.
+type NegativeCacheStats struct {
+	Recorded int64
+	Saved    int64
+}
+
+type negativeEntry struct {
+	key     string
+	expires time.Time
+}
+
+// NegativeCacheBackend remembers the keys which were just reported missing,
+// so repeated lookups of them are answered without a round-trip. Entries
+// expire after a TTL, and a Put of the key from this process removes its
+// entry at once.
+type NegativeCacheBackend struct {
+	inner    Backend
+	ttl      time.Duration
+	capacity int
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently recorded
+	entries map[string]*list.Element
+
+	recorded atomic.Int64
+	saved    atomic.Int64
+}
+
+// NewNegativeCacheBackend wraps inner with a cache of misses kept for
+// "negative-cache-ttl" milliseconds. At most "negative-cache-size" keys are
+// kept (default 10000), the oldest are dropped first.
+func NewNegativeCacheBackend(inner Backend, attributes []Attribute) *NegativeCacheBackend {
+	h := &NegativeCacheBackend{
+		inner:    inner,
+		ttl:      parseTimeout(findAttribute(attributes, "negative-cache-ttl")),
+		capacity: negativeDefaultCapacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	if value := findAttribute(attributes, "negative-cache-size"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			LOG("Invalid negative-cache-size '%s', using %d", value, h.capacity)
+		} else {
+			h.capacity = n
+		}
+	}
+	return h
+}
+
+// Stats returns a snapshot of the counters.
+func (h *NegativeCacheBackend) Stats() NegativeCacheStats {
+	return NegativeCacheStats{
+		Recorded: h.recorded.Load(),
+		Saved:    h.saved.Load(),
+	}
+}
+
+func (s NegativeCacheStats) String() string {
+	return fmt.Sprintf("%d misses recorded/%d round-trips saved", s.Recorded, s.Saved)
+}
+
+func (h *NegativeCacheBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// missing tells whether key was reported missing within the TTL.
+func (h *NegativeCacheBackend) missing(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	elem, ok := h.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(elem.Value.(*negativeEntry).expires) {
+		h.lru.Remove(elem)
+		delete(h.entries, key)
+		return false
+	}
+	return true
+}
+
+// record remembers that key is missing, dropping the oldest entries beyond
+// the capacity.
+func (h *NegativeCacheBackend) record(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	expires := time.Now().Add(h.ttl)
+	if elem, ok := h.entries[key]; ok {
+		elem.Value.(*negativeEntry).expires = expires
+		h.lru.MoveToFront(elem)
+		return
+	}
+	h.entries[key] = h.lru.PushFront(&negativeEntry{key: key, expires: expires})
+	h.recorded.Add(1)
+
+	for h.lru.Len() > h.capacity {
+		oldest := h.lru.Back()
+		h.lru.Remove(oldest)
+		delete(h.entries, oldest.Value.(*negativeEntry).key)
+	}
+}
+
+// forget removes key, which was just stored.
+func (h *NegativeCacheBackend) forget(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if elem, ok := h.entries[key]; ok {
+		h.lru.Remove(elem)
+		delete(h.entries, key)
+	}
+}
+
+// Get reports a recent miss of key without asking the wrapped backend. Only
+// genuine misses are recorded, not those standing in for a server failure.
+func (h *NegativeCacheBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	if h.missing(string(key)) {
+		h.saved.Add(1)
+		LOG("Key %x is known to be missing (%s)", key, h.Stats())
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Key %x is known to be missing", key),
+			Code:    NO_FILE}
+	}
+
+	body, size, err := h.inner.Get(ctx, key)
+	if err != nil {
+		if failureStatus(h.inner, err) == NO_FILE && !isServerFailure(h.inner, err) {
+			h.record(string(key))
+		}
+		return nil, 0, wrappedFailure(h.inner, err)
+	}
+	return body, size, nil
+}
+
+// GetBatch looks up the keys not known to be missing with a batch of the
+// wrapped backend, and remembers those it misses.
+func (h *NegativeCacheBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	var pending []int
+	for i, key := range keys {
+		if !h.missing(string(key)) {
+			pending = append(pending, i)
+			continue
+		}
+		h.saved.Add(1)
+		results[i].Err = &BackendFailure{
+			Message: fmt.Sprintf("Key %x is known to be missing", key),
+			Code:    NO_FILE}
+	}
+
+	for j, result := range getPending(ctx, h.inner, keys, pending, concurrency) {
+		if result.Err != nil {
+			if failureStatus(h.inner, result.Err) == NO_FILE && !isServerFailure(h.inner, result.Err) {
+				h.record(string(keys[pending[j]]))
+			}
+			result.Err = wrappedFailure(h.inner, result.Err)
+		}
+		results[pending[j]] = result
+	}
+	return results
+}
+
+// Put stores the value of key, which is then no longer missing.
+func (h *NegativeCacheBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	ok, err := h.inner.Put(ctx, key, data, onlyIfMissing)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	h.forget(string(key))
+	return ok, nil
+}
+
+func (h *NegativeCacheBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	ok, err := h.inner.PutStream(ctx, key, r, size, onlyIfMissing)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	h.forget(string(key))
+	return ok, nil
+}
+
+func (h *NegativeCacheBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	ok, err := h.inner.Remove(ctx, key)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// Stat reports a recent miss of key without asking the wrapped backend, and
+// records misses like Get.
+func (h *NegativeCacheBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	if h.missing(string(key)) {
+		h.saved.Add(1)
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("Key %x is known to be missing", key),
+			Code:    NO_FILE}
+	}
+
+	info, err := h.inner.Stat(ctx, key)
+	if err != nil {
+		if failureStatus(h.inner, err) == NO_FILE && !isServerFailure(h.inner, err) {
+			h.record(string(key))
+		}
+		return ObjectInfo{}, wrappedFailure(h.inner, err)
+	}
+	return info, nil
+}
+
+func (h *NegativeCacheBackend) Drain() {
+	drain(h.inner)
+}
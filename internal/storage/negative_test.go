@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// countingBackend counts the Gets passed to the wrapped backend.
+type countingBackend struct {
+	Backend
+	gets int
+}
+
+func (c *countingBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	c.gets++
+	return c.Backend.Get(ctx, key)
+}
+
+func TestNegativeCacheBackend(t *testing.T) {
+	inner := &countingBackend{Backend: NewFileBackend(&url.URL{Path: t.TempDir()}, nil)}
+	negative := NewNegativeCacheBackend(inner, []Attribute{{Key: "negative-cache-ttl", Value: "50"}})
+
+	key := []byte{0x01, 0x02, 0x03}
+	for range 3 {
+		_, _, err := negative.Get(t.Context(), key)
+		if err == nil || negative.ResolveProtocolCode(err.(*BackendFailure).Code) != NO_FILE {
+			t.Fatalf("Get() of a missing key = %v, want NO_FILE", err)
+		}
+	}
+	if stats := negative.Stats(); inner.gets != 1 || stats.Saved != 2 || stats.Recorded != 1 {
+		t.Errorf("3 Gets made %d round-trips (%s), want 1", inner.gets, stats)
+	}
+
+	// An entry stored by another client is seen once the TTL expired.
+	inner.Put(t.Context(), key, []byte("object code"), false)
+	if _, _, err := negative.Get(t.Context(), key); err == nil {
+		t.Error("Get() within the TTL should report a miss")
+	}
+	time.Sleep(60 * time.Millisecond)
+	readAll(t, negative, key)
+
+	// A Put from this process is seen at once.
+	other := []byte{0x04, 0x05, 0x06}
+	negative.Get(t.Context(), other)
+	negative.Put(t.Context(), other, []byte("object code"), false)
+	readAll(t, negative, other)
+}
+
+func TestNegativeCacheBackend_Capacity(t *testing.T) {
+	inner := &countingBackend{Backend: NewFileBackend(&url.URL{Path: t.TempDir()}, nil)}
+	negative := NewNegativeCacheBackend(inner, []Attribute{
+		{Key: "negative-cache-ttl", Value: "60000"},
+		{Key: "negative-cache-size", Value: "2"},
+	})
+
+	keys := [][]byte{{0x01, 0x01}, {0x02, 0x02}, {0x03, 0x03}}
+	for _, key := range keys {
+		negative.Get(t.Context(), key)
+	}
+	negative.Get(t.Context(), keys[2])
+	negative.Get(t.Context(), keys[0])
+	if inner.gets != 4 {
+		t.Errorf("%d round-trips, want the oldest miss to be dropped", inner.gets)
+	}
+}
+
+func TestNegativeCacheBackend_ServerFailure(t *testing.T) {
+	down := &downBackend{}
+	breaker := NewCircuitBreakerBackend(down, []Attribute{{Key: "breaker-failure-threshold", Value: "1"}})
+	negative := NewNegativeCacheBackend(breaker, []Attribute{{Key: "negative-cache-ttl", Value: "60000"}})
+
+	key := []byte{0x01, 0x02, 0x03}
+	negative.Get(t.Context(), key)
+	negative.Get(t.Context(), key) // miss reported by the open circuit
+	if stats := negative.Stats(); stats.Recorded != 0 {
+		t.Errorf("server failures were recorded as misses (%s)", stats)
+	}
+}
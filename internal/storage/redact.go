@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"ccache-backend-client/internal/constants"
+)
+
+var (
+	secretName     = regexp.MustCompile(`(?i)secret|key|token|authorization`)
+	urlCredentials = regexp.MustCompile(`(\w+://)[^/@\s]+@`)
+	urlQuery       = regexp.MustCompile(`(\w+://[^\s?"']*)\?[^\s"']+`)
+	authorization  = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[\w.~+/=-]+`)
+)
+
+// secretValue returns the value of attr if it must not leave the helper,
+// e.g. in the error messages sent to ccache: the value of an attribute or
+// a header whose name looks like a secret, key or token.
+func secretValue(attr Attribute) string {
+	name, value := attr.Key, attr.Value
+	if attr.Key == "header" {
+		name, value, _ = strings.Cut(attr.Value, "=")
+	}
+	if secretName.MatchString(name) {
+		return value
+	}
+	return ""
+}
+
+// redactSecrets replaces the credentials found in message: the secret
+// attribute values, the credentials and queries of URLs (the query of a
+// signed URL holds its signature) and authorization headers.
+func redactSecrets(message string) string {
+	for _, attr := range BackendAttributes {
+		if value := secretValue(attr); value != "" {
+			message = strings.ReplaceAll(message, value, "REDACTED")
+		}
+	}
+	message = urlCredentials.ReplaceAllString(message, "${1}REDACTED@")
+	message = urlQuery.ReplaceAllString(message, "${1}?REDACTED")
+	return authorization.ReplaceAllString(message, "$1 REDACTED")
+}
+
+// errorMessage returns message as sent to ccache: without secrets and at
+// most constants.MAX_ERROR_MSG_SIZE bytes long.
+func errorMessage(message string) string {
+	message = redactSecrets(message)
+	if len(message) <= constants.MAX_ERROR_MSG_SIZE {
+		return message
+	}
+
+	const ellipsis = "..."
+	cut := constants.MAX_ERROR_MSG_SIZE - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return message[:cut] + ellipsis
+}
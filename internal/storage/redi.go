@@ -1 +1,461 @@
 package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	urlib "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const (
+	redisDefaultPort   = "6379"
+	redisDefaultPrefix = "ccache"
+	redisMaxIdleConns  = 16
+)
+
+type RedisStorageBackend struct {
+	addr             string
+	username         string
+	password         string
+	database         int
+	prefix           string
+	useTLS           bool
+	connectTimeout   time.Duration
+	operationTimeout time.Duration
+	idle             chan *redisConn
+}
+
+type redisAttributes struct {
+	prefix           string
+	connectTimeout   time.Duration
+	operationTimeout time.Duration
+}
+
+// redisError is an error reply ("-ERR ...") sent by the server.
+type redisError string
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func NewRedisAttributes() *redisAttributes {
+	return &redisAttributes{
+		prefix:           redisDefaultPrefix,
+		connectTimeout:   10 * time.Second,
+		operationTimeout: 10 * time.Second,
+	}
+}
+
+// NewRedisBackend creates a backend for URLs of the form
+// redis[s]://[[USERNAME:]PASSWORD@]HOST[:PORT][/DBNUMBER].
+//
+// Connections are opened lazily and kept in a small idle pool, so creating
+// the backend never touches the network.
+func NewRedisBackend(url *urlib.URL, attributes []Attribute) *RedisStorageBackend {
+	defaultAttrs := NewRedisAttributes()
+	for _, attr := range backendAttributes(attributes) {
+		switch attr.Key {
+		case "connect-timeout":
+			defaultAttrs.connectTimeout = parseTimeout(attr.Value)
+		case "operation-timeout":
+			defaultAttrs.operationTimeout = parseTimeout(attr.Value)
+		case "prefix":
+			defaultAttrs.prefix = attr.Value
+		default:
+			LOG("Redis attribute '%s' not known!", attr.Key)
+		}
+	}
+
+	host := url.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	port := url.Port()
+	if port == "" {
+		port = redisDefaultPort
+	}
+
+	backend := &RedisStorageBackend{
+		addr:             net.JoinHostPort(host, port),
+		prefix:           defaultAttrs.prefix,
+		useTLS:           url.Scheme == "rediss",
+		connectTimeout:   defaultAttrs.connectTimeout,
+		operationTimeout: defaultAttrs.operationTimeout,
+		idle:             make(chan *redisConn, redisMaxIdleConns),
+	}
+
+	// Like ccache, a single user info component is the password.
+	if url.User != nil {
+		if password, ok := url.User.Password(); ok {
+			backend.username = url.User.Username()
+			backend.password = password
+		} else {
+			backend.password = url.User.Username()
+		}
+	}
+
+	if db := strings.Trim(url.Path, "/"); db != "" {
+		index, err := strconv.Atoi(db)
+		if err != nil {
+			LOG("Invalid Redis database index '%s', using 0", db)
+		} else {
+			backend.database = index
+		}
+	}
+
+	return backend
+}
+
+func (h *RedisStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveHttpStatus(code)
+}
+
+func (h *RedisStorageBackend) getKey(key []byte) (string, error) {
+	digest, err := formatDigest(key)
+	if err != nil {
+		return "", err
+	}
+	if h.prefix == "" {
+		return digest, nil
+	}
+	return h.prefix + ":" + digest, nil
+}
+
+// Get retrieves the value stored under key with a GET command.
+//
+// A missing key is reported as a BackendFailure with code 404.
+func (h *RedisStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	redisKey, err := h.getKey(key)
+	if err != nil {
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Local error %x: %v", key, err),
+			Code:    0}
+	}
+
+	reply, err := h.do(ctx, []byte("GET"), []byte(redisKey))
+	if err != nil {
+		return nil, 0, h.failure("get", redisKey, err)
+	}
+
+	switch value := reply.(type) {
+	case nil:
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Key %s not found in Redis", redisKey),
+			Code:    404}
+	case []byte:
+		return io.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+	default:
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Unexpected reply to GET %s: %v", redisKey, reply),
+			Code:    500}
+	}
+}
+
+// Put stores data under key with a SET command.
+//
+// When onlyIfMissing is set the NX option is used, and an existing key
+// results in (false, nil).
+func (h *RedisStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	redisKey, err := h.getKey(key)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Local error %x: %v", key, err),
+			Code:    0}
+	}
+
+	args := [][]byte{[]byte("SET"), []byte(redisKey), data}
+	if onlyIfMissing {
+		args = append(args, []byte("NX"))
+	}
+
+	reply, err := h.do(ctx, args...)
+	if err != nil {
+		return false, h.failure("put", redisKey, err)
+	}
+	if reply == nil {
+		return false, nil // key exists, NX prevented the write
+	}
+
+	return true, nil
+}
+
+// PutStream reads the value into memory, as the Redis commands take it as a whole.
+func (h *RedisStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Stat looks the value up with Get, Redis keeps no modification time.
+func (h *RedisStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	return statByGet(ctx, h, key)
+}
+
+// Remove deletes key with a DEL command.
+//
+// Deleting a key that does not exist is reported with code 404.
+func (h *RedisStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	redisKey, err := h.getKey(key)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Local error %x: %v", key, err),
+			Code:    0}
+	}
+
+	reply, err := h.do(ctx, []byte("DEL"), []byte(redisKey))
+	if err != nil {
+		return false, h.failure("remove", redisKey, err)
+	}
+	if count, ok := reply.(int64); !ok || count == 0 {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Key %s does not exist in Redis", redisKey),
+			Code:    404}
+	}
+
+	return true, nil
+}
+
+// GetBatch looks up all keys with a single MGET, whatever the concurrency.
+// Missing keys are reported with code 404 like by Get.
+func (h *RedisStorageBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	args := [][]byte{[]byte("MGET")}
+	var indices []int // of the keys sent
+	for i, key := range keys {
+		redisKey, err := h.getKey(key)
+		if err != nil {
+			results[i].Err = &BackendFailure{
+				Message: fmt.Sprintf("Local error %x: %v", key, err),
+				Code:    0}
+			continue
+		}
+		args = append(args, []byte(redisKey))
+		indices = append(indices, i)
+	}
+	if len(indices) == 0 {
+		return results
+	}
+
+	reply, err := h.do(ctx, args...)
+	values, ok := reply.([]any)
+	if err == nil && (!ok || len(values) != len(indices)) {
+		err = fmt.Errorf("unexpected reply %v", reply)
+	}
+	for j, i := range indices {
+		redisKey := string(args[j+1])
+		switch {
+		case err != nil:
+			results[i].Err = h.failure("get", redisKey, err)
+		case values[j] == nil:
+			results[i].Err = &BackendFailure{
+				Message: fmt.Sprintf("Key %s not found in Redis", redisKey),
+				Code:    404}
+		default:
+			value, ok := values[j].([]byte)
+			if !ok {
+				results[i].Err = &BackendFailure{
+					Message: fmt.Sprintf("Unexpected reply to MGET %s: %v", redisKey, values[j]),
+					Code:    500}
+			}
+			results[i].Value = value
+		}
+	}
+	return results
+}
+
+// failure wraps an error of a Redis round-trip into a BackendFailure.
+func (h *RedisStorageBackend) failure(op string, redisKey string, err error) *BackendFailure {
+	code := 500
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		code = 408
+	}
+	return &BackendFailure{
+		Message: fmt.Sprintf("Failed to %s %s on Redis %s: %v", op, redisKey, h.addr, err),
+		Code:    code}
+}
+
+// do sends one command on a pooled connection and returns the parsed reply.
+//
+// Connections which saw an I/O error are dropped rather than returned to
+// the pool. Error replies from the server are returned as redisError.
+func (h *RedisStorageBackend) do(ctx context.Context, args ...[]byte) (any, error) {
+	// The deadline of ctx shortens the operation timeout.
+	timeout := h.operationTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, ctx.Err()
+		}
+		if timeout == 0 || left < timeout {
+			timeout = left
+		}
+	}
+
+	c, err := h.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.roundTrip(timeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+
+	h.release(c)
+	return reply, err
+}
+
+func (h *RedisStorageBackend) acquire() (*redisConn, error) {
+	select {
+	case c := <-h.idle:
+		return c, nil
+	default:
+	}
+	return h.dial()
+}
+
+func (h *RedisStorageBackend) release(c *redisConn) {
+	select {
+	case h.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// dial opens a new connection, authenticates and selects the database.
+func (h *RedisStorageBackend) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: h.connectTimeout}
+
+	var conn net.Conn
+	var err error
+	if h.useTLS {
+		host, _, _ := net.SplitHostPort(h.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", h.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", h.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+
+	if h.password != "" {
+		args := [][]byte{[]byte("AUTH"), []byte(h.password)}
+		if h.username != "" {
+			args = [][]byte{[]byte("AUTH"), []byte(h.username), []byte(h.password)}
+		}
+		if _, err := c.roundTrip(h.connectTimeout, args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis authentication failed: %w", err)
+		}
+	}
+
+	if h.database != 0 {
+		db := []byte(strconv.Itoa(h.database))
+		if _, err := c.roundTrip(h.connectTimeout, []byte("SELECT"), db); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select %d failed: %w", h.database, err)
+		}
+	}
+
+	LOG("Connected to Redis at %s", h.addr)
+	return c, nil
+}
+
+// roundTrip writes a command as a RESP array of bulk strings and reads the reply.
+func (c *redisConn) roundTrip(timeout time.Duration, args ...[]byte) (any, error) {
+	if timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n", len(arg))
+		c.writer.Write(arg)
+		c.writer.WriteString("\r\n")
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return readRESP(c.reader)
+}
+
+// readRESP parses a single RESP reply.
+//
+// Replies are returned as string (simple string), int64 (integer),
+// []byte (bulk string), []any (array) or nil (null bulk string or array).
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed RESP line %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]any, count)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown RESP type %q", kind)
+	}
+}
@@ -0,0 +1,248 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is a minimal in-process RESP server understanding the
+// commands used by RedisStorageBackend.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	dbs      map[string]map[string][]byte
+	mgets    int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeRedis{listener: l, password: password, dbs: make(map[string]map[string][]byte)}
+	go f.serve()
+	t.Cleanup(func() { l.Close() })
+	return f
+}
+
+func (f *fakeRedis) url(path string) *url.URL {
+	u, _ := url.Parse("redis://" + f.listener.Addr().String() + path)
+	if f.password != "" {
+		u.User = url.UserPassword("default", f.password)
+	}
+	return u
+}
+
+func (f *fakeRedis) db(name string) map[string][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dbs[name] == nil {
+		f.dbs[name] = make(map[string][]byte)
+	}
+	return f.dbs[name]
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	db, authed := "0", f.password == ""
+
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items := reply.([]any)
+		cmd := strings.ToUpper(string(items[0].([]byte)))
+		args := make([]string, len(items)-1)
+		for i, item := range items[1:] {
+			args[i] = string(item.([]byte))
+		}
+
+		if cmd == "AUTH" {
+			if args[len(args)-1] != f.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			io.WriteString(conn, "+OK\r\n")
+			continue
+		}
+		if !authed {
+			io.WriteString(conn, "-NOAUTH Authentication required\r\n")
+			continue
+		}
+
+		f.mu.Lock()
+		store := f.dbs[db]
+		if store == nil {
+			store = make(map[string][]byte)
+			f.dbs[db] = store
+		}
+		switch cmd {
+		case "SELECT":
+			db = args[0]
+			io.WriteString(conn, "+OK\r\n")
+		case "GET":
+			if value, ok := store[args[0]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				io.WriteString(conn, "$-1\r\n")
+			}
+		case "MGET":
+			f.mgets++
+			fmt.Fprintf(conn, "*%d\r\n", len(args))
+			for _, key := range args {
+				if value, ok := store[key]; ok {
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+				} else {
+					io.WriteString(conn, "$-1\r\n")
+				}
+			}
+		case "SET":
+			if _, ok := store[args[0]]; ok && len(args) > 2 && args[2] == "NX" {
+				io.WriteString(conn, "$-1\r\n")
+			} else {
+				store[args[0]] = []byte(args[1])
+				io.WriteString(conn, "+OK\r\n")
+			}
+		case "DEL":
+			if _, ok := store[args[0]]; ok {
+				delete(store, args[0])
+				io.WriteString(conn, ":1\r\n")
+			} else {
+				io.WriteString(conn, ":0\r\n")
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestRedisStorageBackend_PutGetRemove(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	backend := NewRedisBackend(server.url("/2"), []Attribute{{Key: "prefix", Value: "test"}})
+	key := []byte{0x01, 0x02, 0x03}
+
+	if _, _, err := backend.Get(t.Context(), key); err == nil {
+		t.Fatal("Get() on empty store should fail")
+	} else if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+		t.Errorf("Get() miss resolved to %d, want NO_FILE", code)
+	}
+
+	if ok, err := backend.Put(t.Context(), key, []byte("value"), false); !ok || err != nil {
+		t.Fatalf("Put() = %v, %v", ok, err)
+	}
+	if ok, err := backend.Put(t.Context(), key, []byte("other"), true); ok || err != nil {
+		t.Errorf("Put() with onlyIfMissing on existing key = %v, %v", ok, err)
+	}
+
+	digest, _ := formatDigest(key)
+	if _, ok := server.db("2")["test:"+digest]; !ok {
+		t.Errorf("value not stored under prefixed key in database 2")
+	}
+
+	body, size, err := backend.Get(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	if string(data) != "value" || size != int64(len(data)) {
+		t.Errorf("Get() = %q (size %d), want \"value\"", data, size)
+	}
+
+	if ok, err := backend.Remove(t.Context(), key); !ok || err != nil {
+		t.Errorf("Remove() = %v, %v", ok, err)
+	}
+	if _, err := backend.Remove(t.Context(), key); err == nil {
+		t.Error("Remove() of missing key should fail")
+	}
+}
+
+func TestRedisStorageBackend_WrongPassword(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	u := server.url("")
+	u.User = url.User("wrong")
+	backend := NewRedisBackend(u, nil)
+
+	_, _, err := backend.Get(t.Context(), []byte{0x01, 0x02})
+	if err == nil {
+		t.Fatal("Get() with wrong password should fail")
+	}
+	if code := backend.ResolveProtocolCode(err.(*BackendFailure).Code); code != ERROR {
+		t.Errorf("auth failure resolved to %d, want ERROR", code)
+	}
+}
+
+func TestRedisStorageBackend_GetBatch(t *testing.T) {
+	server := newFakeRedis(t, "")
+	backend := NewRedisBackend(server.url("/0"), nil)
+	keys := [][]byte{{0x01, 0x01}, {0x02, 0x02}, {0x03, 0x03}}
+	backend.Put(t.Context(), keys[0], []byte("manifest"), false)
+	backend.Put(t.Context(), keys[2], []byte("result"), false)
+
+	results := GetBatch(t.Context(), backend, keys, 1)
+	if string(results[0].Value) != "manifest" || string(results[2].Value) != "result" {
+		t.Errorf("GetBatch() values = %q, %q", results[0].Value, results[2].Value)
+	}
+	if err := results[1].Err; err == nil || backend.ResolveProtocolCode(err.(*BackendFailure).Code) != NO_FILE {
+		t.Errorf("GetBatch() of a missing key = %v, want NO_FILE", err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.mgets != 1 {
+		t.Errorf("GetBatch() sent %d MGET commands, want 1", server.mgets)
+	}
+}
+
+func TestRedisStorageBackend_GetBatchLayered(t *testing.T) {
+	server := newFakeRedis(t, "")
+	attributes := []Attribute{
+		{Key: "retry-max-attempts", Value: "3"},
+		{Key: "breaker-failure-threshold", Value: "5"},
+		{Key: "verify-checksums", Value: "true"},
+		{Key: "compression", Value: "zstd"},
+		{Key: "negative-cache-ttl", Value: "60000"},
+		{Key: "coalesce-requests", Value: "true"},
+	}
+	node, err := WrapBackend(WrapRemote(NewRedisBackend(server.url("/0"), nil), attributes), attributes)
+	if err != nil {
+		t.Fatalf("WrapBackend() failed: %v", err)
+	}
+	keys := [][]byte{{0x01, 0x01}, {0x02, 0x02}, {0x03, 0x03}}
+	node.Put(t.Context(), keys[0], []byte("manifest"), false)
+	node.Put(t.Context(), keys[2], []byte("result"), false)
+
+	for range 2 {
+		results := GetBatch(t.Context(), node, keys, 1)
+		if string(results[0].Value) != "manifest" || string(results[2].Value) != "result" {
+			t.Errorf("GetBatch() values = %q, %q", results[0].Value, results[2].Value)
+		}
+		if err := results[1].Err; err == nil || node.ResolveProtocolCode(err.(*BackendFailure).Code) != NO_FILE {
+			t.Errorf("GetBatch() of a missing key = %v, want NO_FILE", err)
+		}
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.mgets != 2 {
+		t.Errorf("GetBatch() sent %d MGET commands, want 1 per batch", server.mgets)
+	}
+}
@@ -0,0 +1,279 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const (
+	replicaDefaultRetryInterval = 30 * time.Second
+	replicaWriteTimeout         = time.Minute
+)
+
+type replica struct {
+	name string
+	node Backend
+
+	// Guarded by ReplicatedStorageBackend.mu
+	latency        time.Duration // moving average of Get response times
+	unhealthyUntil time.Time
+}
+
+// ReplicatedStorageBackend stores every entry on several independent
+// backends. Writes succeed once a quorum of replicas acknowledged them,
+// reads are served by the fastest healthy replica.
+type ReplicatedStorageBackend struct {
+	replicas      []*replica
+	quorum        int
+	retryInterval time.Duration
+
+	mu      sync.Mutex
+	pending sync.WaitGroup // writes still running after Put returned
+}
+
+type replicaResult struct {
+	index int
+	ok    bool
+	err   error
+}
+
+// NewReplicatedBackend creates a backend replicating entries to nodes, which
+// are identified by the names in names (their URLs).
+//
+// The "write-quorum" attribute sets the number of replicas which must accept
+// a write (default: a majority). A replica failing with a server failure
+// (see isServerFailure) is only used as a last resort for "replica-retry-interval" milliseconds
+// (default 30000).
+func NewReplicatedBackend(names []string, nodes []Backend, attributes []Attribute) *ReplicatedStorageBackend {
+	h := &ReplicatedStorageBackend{
+		quorum:        len(nodes)/2 + 1,
+		retryInterval: replicaDefaultRetryInterval,
+	}
+	for i, node := range nodes {
+		h.replicas = append(h.replicas, &replica{name: names[i], node: node})
+	}
+
+	if value := findAttribute(attributes, "write-quorum"); value != "" {
+		quorum, err := strconv.Atoi(value)
+		if err != nil || quorum < 1 || quorum > len(nodes) {
+			LOG("Invalid write-quorum '%s' for %d replicas, using %d", value, len(nodes), h.quorum)
+		} else {
+			h.quorum = quorum
+		}
+	}
+	if value := findAttribute(attributes, "replica-retry-interval"); value != "" {
+		h.retryInterval = parseTimeout(value)
+	}
+	return h
+}
+
+func (h *ReplicatedStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// rank orders the replicas for reading: healthy before unhealthy ones, then
+// by their average response time.
+func (h *ReplicatedStorageBackend) rank() []*replica {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	order := append([]*replica(nil), h.replicas...)
+	sort.SliceStable(order, func(a, b int) bool {
+		healthyA, healthyB := now.After(order[a].unhealthyUntil), now.After(order[b].unhealthyUntil)
+		if healthyA != healthyB {
+			return healthyA
+		}
+		return order[a].latency < order[b].latency
+	})
+	return order
+}
+
+// report records the outcome of a request to r. Server failures mark the
+// replica unhealthy, elapsed updates the latency average.
+func (h *ReplicatedStorageBackend) report(r *replica, err error, elapsed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil && isServerFailure(r.node, err) {
+		LOG("Replica %s failed: %v", r.name, err)
+		r.unhealthyUntil = time.Now().Add(h.retryInterval)
+		return
+	}
+
+	r.unhealthyUntil = time.Time{}
+	if r.latency == 0 {
+		r.latency = elapsed
+	} else {
+		r.latency = (3*r.latency + elapsed) / 4
+	}
+}
+
+// Get reads key from the fastest healthy replica. As writes may only have
+// reached a quorum, a miss moves on to the next replica as well.
+func (h *ReplicatedStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	var failure *BackendFailure
+	for _, r := range h.rank() {
+		start := time.Now()
+		body, size, err := r.node.Get(ctx, key)
+		h.report(r, err, time.Since(start))
+		if err == nil {
+			return body, size, nil
+		}
+
+		if bf := wrappedFailure(r.node, err); bf.Code != NO_FILE && failure == nil {
+			failure = bf
+		}
+	}
+
+	if failure != nil {
+		return nil, 0, failure
+	}
+	return nil, 0, &BackendFailure{
+		Message: fmt.Sprintf("No replica holds %x", key),
+		Code:    NO_FILE}
+}
+
+// fanOut runs op on all replicas concurrently and returns a channel
+// delivering each result.
+func (h *ReplicatedStorageBackend) fanOut(op func(r *replica) (bool, error)) <-chan replicaResult {
+	results := make(chan replicaResult, len(h.replicas))
+	for i, r := range h.replicas {
+		h.pending.Add(1)
+		go func() {
+			defer h.pending.Done()
+			ok, err := op(r)
+			if err != nil {
+				h.report(r, err, 0)
+			}
+			results <- replicaResult{index: i, ok: ok, err: err}
+		}()
+	}
+	return results
+}
+
+// Put writes data to all replicas concurrently and returns as soon as the
+// write quorum acknowledged. Writes to the remaining replicas complete in
+// the background, so they work on a copy of data: the caller may reuse its
+// buffer once Put returned. Neither are they canceled with the request, but
+// they are bounded by its deadline (one minute without) and by Drain.
+func (h *ReplicatedStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	key, data = bytes.Clone(key), bytes.Clone(data)
+	background, cancel := detachedContext(ctx, replicaWriteTimeout)
+	var writes sync.WaitGroup
+	writes.Add(len(h.replicas))
+	results := h.fanOut(func(r *replica) (bool, error) {
+		defer writes.Done()
+		return r.node.Put(background, key, data, onlyIfMissing)
+	})
+	go func() {
+		writes.Wait()
+		cancel()
+	}()
+
+	var failure *BackendFailure
+	acks, failures, stored := 0, 0, false
+	for range h.replicas {
+		result := <-results
+		if result.err != nil {
+			failures++
+			if failure == nil {
+				failure = wrappedFailure(h.replicas[result.index].node, result.err)
+			}
+			if failures > len(h.replicas)-h.quorum {
+				break
+			}
+			continue
+		}
+
+		acks++
+		stored = stored || result.ok
+		if acks >= h.quorum {
+			return stored, nil
+		}
+	}
+
+	return false, &BackendFailure{
+		Message: fmt.Sprintf("Write quorum of %d not reached (%d acknowledged): %s", h.quorum, acks, failure.Message),
+		Code:    failure.Code,
+		class:   failure.class}
+}
+
+// PutStream reads the value into memory, to send it to all replicas.
+func (h *ReplicatedStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Remove deletes key from all replicas.
+func (h *ReplicatedStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	results := h.fanOut(func(r *replica) (bool, error) {
+		return r.node.Remove(ctx, key)
+	})
+
+	var failure *BackendFailure
+	removed := false
+	for range h.replicas {
+		result := <-results
+		if result.err != nil {
+			node := h.replicas[result.index].node
+			if bf := wrappedFailure(node, result.err); bf.Code != NO_FILE && failure == nil {
+				failure = bf
+			}
+			continue
+		}
+		removed = removed || result.ok
+	}
+
+	if removed {
+		return true, nil
+	}
+	if failure != nil {
+		return false, failure
+	}
+	return false, &BackendFailure{
+		Message: fmt.Sprintf("No replica holds %x", key),
+		Code:    NO_FILE}
+}
+
+// Stat asks the replicas in the order of Get, as the value may only have
+// reached some of them.
+func (h *ReplicatedStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	var failure *BackendFailure
+	for _, r := range h.rank() {
+		start := time.Now()
+		info, err := r.node.Stat(ctx, key)
+		h.report(r, err, time.Since(start))
+		if err == nil {
+			return info, nil
+		}
+
+		if bf := wrappedFailure(r.node, err); bf.Code != NO_FILE && failure == nil {
+			failure = bf
+		}
+	}
+
+	if failure != nil {
+		return ObjectInfo{}, failure
+	}
+	return ObjectInfo{}, &BackendFailure{
+		Message: fmt.Sprintf("No replica holds %x", key),
+		Code:    NO_FILE}
+}
+
+// Drain waits for the writes still running after Put returned, then for
+// the background requests of the replicas.
+func (h *ReplicatedStorageBackend) Drain() {
+	h.pending.Wait()
+	for _, r := range h.replicas {
+		drain(r.node)
+	}
+}
@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// blockedBackend delays every Put until released.
+type blockedBackend struct {
+	Backend
+	release chan struct{}
+}
+
+func (b *blockedBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	<-b.release
+	return b.Backend.Put(ctx, key, data, onlyIfMissing)
+}
+
+func TestReplicatedStorageBackend_Quorum(t *testing.T) {
+	key := []byte{0x01, 0x02, 0x03}
+
+	tests := []struct {
+		quorum  string
+		succeed bool
+	}{
+		{"", true}, // majority of 3
+		{"1", true},
+		{"2", true},
+		{"3", false},
+	}
+
+	for _, tt := range tests {
+		down := &downBackend{}
+		blocked := &blockedBackend{NewFileBackend(&url.URL{Path: t.TempDir()}, nil), make(chan struct{})}
+		up := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+		replicas := NewReplicatedBackend([]string{"down", "blocked", "up"}, []Backend{down, blocked, up},
+			[]Attribute{{Key: "write-quorum", Value: tt.quorum}})
+
+		done := make(chan error)
+		go func() {
+			_, err := replicas.Put(t.Context(), key, []byte("value"), false)
+			done <- err
+		}()
+
+		if tt.quorum == "1" {
+			// The quorum is reached without waiting for the blocked replica.
+			if err := <-done; err != nil {
+				t.Errorf("Put() with write-quorum 1 failed: %v", err)
+			}
+			close(blocked.release)
+		} else {
+			close(blocked.release)
+			if err := <-done; (err == nil) != tt.succeed {
+				t.Errorf("Put() with write-quorum '%s' = %v, want success %v", tt.quorum, err, tt.succeed)
+			}
+		}
+
+		// Let the writes completing in the background finish before the
+		// temporary directories are removed.
+		replicas.Drain()
+	}
+}
+
+func TestReplicatedStorageBackend_PutCopiesData(t *testing.T) {
+	key := []byte{0x01, 0x02, 0x03}
+	blocked := &blockedBackend{NewFileBackend(&url.URL{Path: t.TempDir()}, nil), make(chan struct{})}
+	up := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	replicas := NewReplicatedBackend([]string{"up", "blocked"}, []Backend{up, blocked},
+		[]Attribute{{Key: "write-quorum", Value: "1"}})
+
+	data := []byte("value")
+	if _, err := replicas.Put(t.Context(), key, data, false); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	// The caller reuses its buffer while the slow replica is still writing.
+	copy(data, "xxxxx")
+	close(blocked.release)
+	replicas.Drain()
+
+	if data := readAll(t, blocked, key); string(data) != "value" {
+		t.Errorf("slow replica stored %q, want \"value\"", data)
+	}
+}
+
+// stuckBackend never completes a Put before its context is done.
+type stuckBackend struct {
+	Backend
+}
+
+func (b *stuckBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func TestReplicatedStorageBackend_BackgroundDeadline(t *testing.T) {
+	key := []byte{0x01, 0x02, 0x03}
+	up := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	replicas := NewReplicatedBackend([]string{"up", "stuck"}, []Backend{up, &stuckBackend{up}},
+		[]Attribute{{Key: "write-quorum", Value: "1"}})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	_, err := replicas.Put(ctx, key, []byte("value"), false)
+	cancel()
+	if err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	// The write to the stuck replica outlives the request, not its deadline.
+	start := time.Now()
+	replicas.Drain()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Drain() took %v waiting for a stuck replica", elapsed)
+	}
+}
+
+func TestReplicatedStorageBackend_Get(t *testing.T) {
+	key := []byte{0x01, 0x02, 0x03}
+	down := &downBackend{}
+	up := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	empty := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	replicas := NewReplicatedBackend([]string{"empty", "down", "up"}, []Backend{empty, down, up}, nil)
+
+	up.Put(t.Context(), key, []byte("value"), false)
+	for range 3 {
+		if data := readAll(t, replicas, key); string(data) != "value" {
+			t.Errorf("Get() = %q, want \"value\"", data)
+		}
+	}
+	if down.calls != 1 {
+		t.Errorf("unhealthy replica was called %d times, want 1", down.calls)
+	}
+
+	if ok, err := replicas.Remove(t.Context(), key); !ok || err != nil {
+		t.Errorf("Remove() = %v, %v", ok, err)
+	}
+	if _, _, err := up.Get(t.Context(), key); err == nil {
+		t.Error("Remove() did not reach all replicas")
+	}
+}
@@ -0,0 +1,219 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const (
+	retryDefaultMaxAttempts    = 1
+	retryDefaultInitialBackoff = 100 * time.Millisecond
+	retryDefaultMaxBackoff     = 2 * time.Second
+	retryDefaultDeadline       = 10 * time.Second
+)
+
+// RetryingStorageBackend repeats requests failing with a transient failure
+// (see isTransientFailure) after an exponentially growing, jittered delay.
+// Misses and rejected requests are returned at once.
+type RetryingStorageBackend struct {
+	inner          Backend
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	deadline       time.Duration
+
+	retries atomic.Int64
+}
+
+// NewRetryingBackend wraps inner with retries.
+//
+// The "retry-max-attempts" attribute sets the number of attempts per request
+// (default 1, no retries). The delay before the n-th retry is random between 0 and
+// "retry-initial-backoff" * 2^n, at most "retry-max-backoff" (default 100
+// and 2000). No retry starts after "retry-deadline" (default 10000) from the
+// first attempt. All durations are in milliseconds.
+func NewRetryingBackend(inner Backend, attributes []Attribute) *RetryingStorageBackend {
+	h := &RetryingStorageBackend{
+		inner:          inner,
+		maxAttempts:    retryDefaultMaxAttempts,
+		initialBackoff: retryDefaultInitialBackoff,
+		maxBackoff:     retryDefaultMaxBackoff,
+		deadline:       retryDefaultDeadline,
+	}
+
+	if value := findAttribute(attributes, "retry-max-attempts"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			LOG("Invalid retry-max-attempts '%s', using %d", value, h.maxAttempts)
+		} else {
+			h.maxAttempts = n
+		}
+	}
+	if value := findAttribute(attributes, "retry-initial-backoff"); value != "" {
+		h.initialBackoff = parseTimeout(value)
+	}
+	if value := findAttribute(attributes, "retry-max-backoff"); value != "" {
+		h.maxBackoff = parseTimeout(value)
+	}
+	if value := findAttribute(attributes, "retry-deadline"); value != "" {
+		h.deadline = parseTimeout(value)
+	}
+	return h
+}
+
+// Retries returns the number of retries made so far.
+func (h *RetryingStorageBackend) Retries() int64 {
+	return h.retries.Load()
+}
+
+func (h *RetryingStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// backoff returns the jittered delay before retry number attempt (from 1).
+func (h *RetryingStorageBackend) backoff(attempt int) time.Duration {
+	limit := h.maxBackoff
+	if shift := attempt - 1; shift < 32 && h.initialBackoff<<shift < limit {
+		limit = h.initialBackoff << shift
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit + 1)
+}
+
+// do runs op until it succeeds, fails for good or the attempts or the
+// deadline are exhausted. The deadline of ctx ends the retries too. The
+// error returned is the one of the last attempt; it isn't a server failure
+// if the attempt failed because ctx ended.
+func (h *RetryingStorageBackend) do(ctx context.Context, op func() error) error {
+	deadline := time.Now().Add(h.deadline)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if attempt >= h.maxAttempts || ctx.Err() != nil || !isTransientFailure(h.inner, err) {
+			return abandonedFailure(ctx, h.inner, err)
+		}
+
+		delay := h.backoff(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			LOG("Not retrying after %d attempts, deadline reached: %v", attempt, err)
+			return abandonedFailure(ctx, h.inner, err)
+		}
+
+		h.retries.Add(1)
+		LOG("Attempt %d failed, retrying in %v: %v", attempt, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return abandonedFailure(ctx, h.inner, err)
+		}
+	}
+}
+
+func (h *RetryingStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	var body io.ReadCloser
+	var size int64
+	err := h.do(ctx, func() (err error) {
+		body, size, err = h.inner.Get(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, size, nil
+}
+
+// GetBatch looks up keys with a batch of the wrapped backend. The keys
+// failing with a transient failure are retried together in the next batch.
+func (h *RetryingStorageBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	pending := make([]int, len(keys))
+	for i := range pending {
+		pending[i] = i
+	}
+	h.do(ctx, func() (err error) {
+		var failed []int
+		for j, result := range getPending(ctx, h.inner, keys, pending, concurrency) {
+			results[pending[j]] = result
+			if result.Err != nil && isTransientFailure(h.inner, result.Err) {
+				failed = append(failed, pending[j])
+				if err == nil {
+					err = result.Err
+				}
+			}
+		}
+		pending = failed
+		return err
+	})
+
+	for i := range results {
+		if results[i].Err != nil {
+			results[i].Err = abandonedFailure(ctx, h.inner, results[i].Err)
+		}
+	}
+	return results
+}
+
+func (h *RetryingStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	var ok bool
+	err := h.do(ctx, func() (err error) {
+		ok, err = h.inner.Put(ctx, key, data, onlyIfMissing)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// PutStream stores the value read from r with a single attempt, as a value
+// partly read can't be sent again.
+func (h *RetryingStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	ok, err := h.inner.PutStream(ctx, key, r, size, onlyIfMissing)
+	if err != nil {
+		return false, abandonedFailure(ctx, h.inner, err)
+	}
+	return ok, nil
+}
+
+func (h *RetryingStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	var ok bool
+	err := h.do(ctx, func() (err error) {
+		ok, err = h.inner.Remove(ctx, key)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (h *RetryingStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := h.do(ctx, func() (err error) {
+		info, err = h.inner.Stat(ctx, key)
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return info, nil
+}
+
+func (h *RetryingStorageBackend) Drain() {
+	drain(h.inner)
+}
@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// flakyBackend fails the first failures requests like an overloaded server,
+// then passes them to inner.
+type flakyBackend struct {
+	Backend
+	failures int
+	calls    int
+}
+
+func (f *flakyBackend) fail() bool {
+	f.calls++
+	return f.calls <= f.failures
+}
+
+func (f *flakyBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	if f.fail() {
+		return nil, 0, &BackendFailure{Message: "service unavailable", Code: 503}
+	}
+	return f.Backend.Get(ctx, key)
+}
+
+func (f *flakyBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	if f.fail() {
+		return false, &BackendFailure{Message: "service unavailable", Code: 503}
+	}
+	return f.Backend.Put(ctx, key, data, onlyIfMissing)
+}
+
+func newRetryAttributes(attempts string) []Attribute {
+	return []Attribute{
+		{Key: "retry-max-attempts", Value: attempts},
+		{Key: "retry-initial-backoff", Value: "1"},
+		{Key: "retry-max-backoff", Value: "5"},
+	}
+}
+
+func TestRetryingStorageBackend(t *testing.T) {
+	inner := &flakyBackend{Backend: NewFileBackend(&url.URL{Path: t.TempDir()}, nil), failures: 2}
+	retrying := NewRetryingBackend(inner, newRetryAttributes("3"))
+
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+	if ok, err := retrying.Put(t.Context(), key, value, false); !ok || err != nil {
+		t.Fatalf("Put() = %v, %v", ok, err)
+	}
+	if inner.calls != 3 || retrying.Retries() != 2 {
+		t.Errorf("Put() made %d calls and %d retries, want 3 and 2", inner.calls, retrying.Retries())
+	}
+
+	inner.calls, inner.failures = 0, 3
+	if _, _, err := retrying.Get(t.Context(), key); err == nil {
+		t.Error("Get() failing more often than the attempts should fail")
+	}
+	if inner.calls != 3 {
+		t.Errorf("Get() made %d calls, want 3", inner.calls)
+	}
+	if data := readAll(t, retrying, key); !bytes.Equal(data, value) {
+		t.Errorf("Get() = %q, want %q", data, value)
+	}
+}
+
+func TestRetryingStorageBackend_NotRetried(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	tests := []struct {
+		name  string
+		inner Backend
+	}{
+		{"miss", files},
+		{"forbidden", &rejectingBackend{code: 403}},
+		{"wrapped miss", NewChecksummedBackend(files, nil)},
+	}
+
+	for _, tt := range tests {
+		retrying := NewRetryingBackend(tt.inner, newRetryAttributes("5"))
+		if _, _, err := retrying.Get(t.Context(), []byte{0x01, 0x02, 0x03}); err == nil {
+			t.Errorf("Get() of %s should fail", tt.name)
+		}
+		if retrying.Retries() != 0 {
+			t.Errorf("Get() of %s was retried %d times", tt.name, retrying.Retries())
+		}
+	}
+}
+
+func TestRetryingStorageBackend_Wrapped(t *testing.T) {
+	down := &downBackend{}
+	retrying := NewRetryingBackend(NewChecksummedBackend(down, nil), newRetryAttributes("4"))
+
+	if _, _, err := retrying.Get(t.Context(), []byte{0x01, 0x02, 0x03}); err == nil {
+		t.Fatal("Get() from a down backend should fail")
+	}
+	if down.calls != 4 {
+		t.Errorf("Get() through a wrapping backend made %d calls, want 4", down.calls)
+	}
+}
+
+func TestRetryingStorageBackend_Deadline(t *testing.T) {
+	down := &downBackend{}
+	retrying := NewRetryingBackend(down, []Attribute{
+		{Key: "retry-max-attempts", Value: "1000"},
+		{Key: "retry-initial-backoff", Value: "20"},
+		{Key: "retry-max-backoff", Value: "20"},
+		{Key: "retry-deadline", Value: "100"},
+	})
+
+	start := time.Now()
+	if _, err := retrying.Remove(t.Context(), []byte{0x01, 0x02, 0x03}); err == nil {
+		t.Fatal("Remove() from a down backend should fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Remove() took %v despite a deadline of 100ms", elapsed)
+	}
+	if down.calls < 2 || down.calls >= 1000 {
+		t.Errorf("Remove() made %d calls", down.calls)
+	}
+}
+
+func TestRetryingStorageBackend_Backoff(t *testing.T) {
+	retrying := NewRetryingBackend(nil, []Attribute{
+		{Key: "retry-initial-backoff", Value: "100"},
+		{Key: "retry-max-backoff", Value: "1000"},
+	})
+
+	for attempt, limit := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		limit *= time.Millisecond
+		for range 50 {
+			if delay := retrying.backoff(attempt + 1); delay < 0 || delay > limit {
+				t.Fatalf("backoff(%d) = %v, want at most %v", attempt+1, delay, limit)
+			}
+		}
+	}
+}
+
+func TestRetryingStorageBackend_ContextDeadline(t *testing.T) {
+	inner := &flakyBackend{Backend: NewFileBackend(&url.URL{Path: t.TempDir()}, nil), failures: 100}
+	retrying := NewRetryingBackend(inner, []Attribute{
+		{Key: "retry-max-attempts", Value: "100"},
+		{Key: "retry-initial-backoff", Value: "20"},
+		{Key: "retry-max-backoff", Value: "20"},
+	})
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := retrying.Get(ctx, []byte{0x01, 0x02, 0x03}); err == nil {
+		t.Fatal("Get() failing on every attempt should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond || inner.calls >= 100 {
+		t.Errorf("Get() made %d calls in %v, want the retries to stop at the deadline", inner.calls, elapsed)
+	}
+}
+
+func TestRetryingStorageBackend_Abandoned(t *testing.T) {
+	up := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	retrying := NewRetryingBackend(&stuckBackend{up}, newRetryAttributes("3"))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	_, err := retrying.Put(ctx, []byte{0x01, 0x02, 0x03}, []byte("object code"), false)
+	if err == nil {
+		t.Fatal("Put() past the deadline succeeded")
+	}
+	if isServerFailure(retrying, err) || isTransientFailure(retrying, err) {
+		t.Errorf("Put() past the deadline reported a server failure: %v", err)
+	}
+}
@@ -0,0 +1,395 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	urlib "net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+)
+
+// sha256 of an empty payload, used for requests without a body.
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+type S3Attributes struct {
+	Region            string
+	Endpoint          string
+	PathStyle         bool
+	pathStyleSet      bool
+	Credentials       S3Credentials
+	connectionTimeout time.Duration
+	operationTimeout  time.Duration
+}
+
+type S3StorageBackend struct {
+	client      *http.Client
+	bucketName  string
+	location    string
+	region      string
+	endpoint    urlib.URL
+	pathStyle   bool
+	credentials S3Credentials
+}
+
+// NewS3Attributes returns attributes initialised from the standard AWS
+// environment variables. Backend attributes take precedence over them.
+func NewS3Attributes() *S3Attributes {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	return &S3Attributes{
+		Region: region,
+		Credentials: S3Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+}
+
+// NewS3Backend creates a backend for URLs of the form s3://BUCKET[/PREFIX].
+//
+// Without an "endpoint" attribute requests go to AWS. With one (e.g. a MinIO
+// server) path-style addressing is used unless "path-style" says otherwise.
+func NewS3Backend(url *urlib.URL, attributes []Attribute) *S3StorageBackend {
+	defaultAttrs := NewS3Attributes()
+	for _, attr := range backendAttributes(attributes) {
+		switch attr.Key {
+		case "region":
+			defaultAttrs.Region = attr.Value
+		case "endpoint":
+			defaultAttrs.Endpoint = attr.Value
+		case "path-style":
+			defaultAttrs.PathStyle = attr.Value == "true"
+			defaultAttrs.pathStyleSet = true
+		case "access-key-id":
+			defaultAttrs.Credentials.AccessKeyID = attr.Value
+		case "secret-access-key":
+			defaultAttrs.Credentials.SecretAccessKey = attr.Value
+		case "session-token":
+			defaultAttrs.Credentials.SessionToken = attr.Value
+		case "connect-timeout":
+			defaultAttrs.connectionTimeout = parseTimeout(attr.Value)
+		case "operation-timeout":
+			defaultAttrs.operationTimeout = parseTimeout(attr.Value)
+		default:
+			LOG("S3 attribute '%s' not known!", attr.Key)
+		}
+	}
+
+	endpoint := defaultAttrs.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", defaultAttrs.Region)
+	} else if !defaultAttrs.pathStyleSet {
+		defaultAttrs.PathStyle = true
+	}
+
+	endpointUrl, err := urlib.Parse(endpoint)
+	if err != nil || endpointUrl.Host == "" {
+		LOG("Invalid S3 endpoint '%s'", endpoint)
+		return nil
+	}
+
+	if defaultAttrs.Credentials.AccessKeyID == "" {
+		LOG("No S3 credentials configured, sending unsigned requests")
+	}
+
+	transport := newHttpTransport(defaultAttrs.connectionTimeout)
+	return &S3StorageBackend{
+		client:      &http.Client{Transport: transport, Timeout: defaultAttrs.operationTimeout},
+		bucketName:  url.Host,
+		location:    getObjectPrefix(url),
+		region:      defaultAttrs.Region,
+		endpoint:    *endpointUrl,
+		pathStyle:   defaultAttrs.PathStyle,
+		credentials: defaultAttrs.Credentials,
+	}
+}
+
+func (h *S3StorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveHttpStatus(code)
+}
+
+// getObjectUrl returns the URL of the object stored for key.
+func (h *S3StorageBackend) getObjectUrl(key []byte) (string, error) {
+	objectName, err := formatDigest(key)
+	if err != nil {
+		return "", err
+	}
+	objectName = h.location + objectName
+
+	u := h.endpoint
+	if h.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + h.bucketName + "/" + objectName
+	} else {
+		u.Host = h.bucketName + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + objectName
+	}
+	return u.String(), nil
+}
+
+// newRequest builds a signed request for the object stored under key.
+func (h *S3StorageBackend) newRequest(ctx context.Context, method string, key []byte, data []byte) (*http.Request, error) {
+	objectUrl, err := h.getObjectUrl(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	payloadHash := s3EmptyPayloadHash
+	if data != nil {
+		body = bytes.NewReader(data)
+		sum := sha256.Sum256(data)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, objectUrl, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.credentials.AccessKeyID != "" {
+		signV4(req, payloadHash, h.credentials, h.region, time.Now())
+	}
+	return req, nil
+}
+
+// Get retrieves the object stored under key.
+//
+// The errors returned are of type BackendFailure carrying the HTTP status
+// code of the S3 response.
+func (h *S3StorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	req, err := h.newRequest(ctx, "GET", key, nil)
+	if err != nil {
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create S3 request for %x: %v", key, err),
+			Code:    0}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("S3 request failed: %v", err),
+			Code:    http.StatusInternalServerError}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Failed to get %s from S3 (%s)", req.URL.Path, resp.Status),
+			Code:    resp.StatusCode}
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// Put uploads data under key.
+//
+// When onlyIfMissing is set the upload is conditional (If-None-Match: *) and
+// an existing object results in (false, nil).
+func (h *S3StorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	if data == nil {
+		data = []byte{}
+	}
+	req, err := h.newRequest(ctx, "PUT", key, data)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create S3 request for %x: %v", key, err),
+			Code:    0}
+	}
+	if onlyIfMissing {
+		// Added after signing, If-None-Match does not need to be signed.
+		req.Header.Set("If-None-Match", "*")
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("S3 request failed: %v", err),
+			Code:    http.StatusInternalServerError}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return false, nil // object exists
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to put %s to S3 (%s)", req.URL.Path, resp.Status),
+			Code:    resp.StatusCode}
+	}
+
+	return true, nil
+}
+
+// PutStream reads the value into memory, as its hash is part of the request signature.
+func (h *S3StorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Stat looks the object up with a HEAD request, which S3 answers with the
+// size and modification time of the object but without its content.
+func (h *S3StorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	req, err := h.newRequest(ctx, "HEAD", key, nil)
+	if err != nil {
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create S3 request for %x: %v", key, err),
+			Code:    0}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("S3 request failed: %v", err),
+			Code:    http.StatusInternalServerError}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ObjectInfo{}, &BackendFailure{
+			Message: fmt.Sprintf("Failed to stat %s in S3 (%s)", req.URL.Path, resp.Status),
+			Code:    resp.StatusCode}
+	}
+
+	info := ObjectInfo{Size: resp.ContentLength}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = modified
+	}
+	return info, nil
+}
+
+// Remove deletes the object stored under key.
+func (h *S3StorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	req, err := h.newRequest(ctx, "DELETE", key, nil)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to create S3 request for %x: %v", key, err),
+			Code:    0}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("S3 request failed: %v", err),
+			Code:    http.StatusInternalServerError}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to delete %s from S3 (%s)", req.URL.Path, resp.Status),
+			Code:    resp.StatusCode}
+	}
+
+	return true, nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req.
+//
+// The host and every header already present on req are signed, so headers
+// that should stay unsigned must be added afterwards.
+func signV4(req *http.Request, payloadHash string, creds S3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	date := now.UTC().Format(s3DateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, s3Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm, amzDate, scope, hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath URI-encodes every path segment as required by SigV4 for S3.
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,222 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const shardDefaultRetryInterval = 30 * time.Second
+
+type shardNode struct {
+	name string
+	node Backend
+}
+
+// ShardedStorageBackend spreads keys over several backends using rendezvous
+// hashing: every key is owned by the node with the highest hash of node name
+// and key, so adding or removing one of N nodes only moves about 1/N of the
+// keys.
+//
+// A node failing with a server failure (see isServerFailure) is considered
+// unhealthy for the retry interval. Its keys fail over to the node with the
+// next highest hash.
+type ShardedStorageBackend struct {
+	nodes         []shardNode
+	retryInterval time.Duration
+
+	mu        sync.Mutex
+	unhealthy map[int]time.Time // node index -> time it may be retried
+}
+
+// NewShardedBackend creates a backend distributing keys over nodes, which
+// are identified by the names in names (their URLs).
+//
+// The "shard-retry-interval" attribute sets how many milliseconds a failed
+// node is skipped (default 30000).
+func NewShardedBackend(names []string, nodes []Backend, attributes []Attribute) *ShardedStorageBackend {
+	h := &ShardedStorageBackend{
+		retryInterval: shardDefaultRetryInterval,
+		unhealthy:     make(map[int]time.Time),
+	}
+	for i, node := range nodes {
+		h.nodes = append(h.nodes, shardNode{name: names[i], node: node})
+	}
+	if value := findAttribute(attributes, "shard-retry-interval"); value != "" {
+		h.retryInterval = parseTimeout(value)
+	}
+	return h
+}
+
+// shardScore is the rendezvous hash of key on the node called name.
+func shardScore(name string, key []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	hash.Write([]byte{0})
+	hash.Write(key)
+
+	// FNV alone distributes similar inputs poorly, finish with a mixer.
+	score := hash.Sum64()
+	score ^= score >> 33
+	score *= 0xff51afd7ed558ccd
+	score ^= score >> 33
+	score *= 0xc4ceb9fe1a85ec53
+	score ^= score >> 33
+	return score
+}
+
+// rank returns the node indices ordered by preference for key. Healthy
+// nodes come first, so unhealthy ones are only tried as a last resort.
+func (h *ShardedStorageBackend) rank(key []byte) []int {
+	scores := make([]uint64, len(h.nodes))
+	order := make([]int, len(h.nodes))
+	for i, n := range h.nodes {
+		scores[i] = shardScore(n.name, key)
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	sort.SliceStable(order, func(a, b int) bool {
+		return !h.isUnhealthy(order[a], now) && h.isUnhealthy(order[b], now)
+	})
+	return order
+}
+
+func (h *ShardedStorageBackend) isUnhealthy(i int, now time.Time) bool {
+	until, ok := h.unhealthy[i]
+	return ok && now.Before(until)
+}
+
+// report records the outcome of a request to node i and tells whether the
+// request should fail over to the next node. Only server failures do, a
+// request the node rejected would fail on the others as well.
+func (h *ShardedStorageBackend) report(i int, err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil || !isServerFailure(h.nodes[i].node, err) {
+		if _, ok := h.unhealthy[i]; ok {
+			LOG("Shard %s is healthy again", h.nodes[i].name)
+			delete(h.unhealthy, i)
+		}
+		return false
+	}
+
+	LOG("Shard %s failed, skipping it for %v: %v", h.nodes[i].name, h.retryInterval, err)
+	h.unhealthy[i] = time.Now().Add(h.retryInterval)
+	return true
+}
+
+func (h *ShardedStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// Get fetches key from the node owning it. A miss is final, only server
+// failures fail over to the next node.
+func (h *ShardedStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	var failure *BackendFailure
+	for _, i := range h.rank(key) {
+		node := h.nodes[i].node
+		body, size, err := node.Get(ctx, key)
+		if !h.report(i, err) {
+			if err != nil {
+				return nil, 0, wrappedFailure(node, err)
+			}
+			return body, size, nil
+		}
+		if failure == nil {
+			failure = wrappedFailure(node, err)
+		}
+	}
+	return nil, 0, h.exhausted(failure)
+}
+
+// Put stores key on the node owning it.
+func (h *ShardedStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	var failure *BackendFailure
+	for _, i := range h.rank(key) {
+		node := h.nodes[i].node
+		ok, err := node.Put(ctx, key, data, onlyIfMissing)
+		if !h.report(i, err) {
+			if err != nil {
+				return false, wrappedFailure(node, err)
+			}
+			return ok, nil
+		}
+		if failure == nil {
+			failure = wrappedFailure(node, err)
+		}
+	}
+	return false, h.exhausted(failure)
+}
+
+// PutStream reads the value into memory, so a write failing on one
+// node can fail over to the next.
+func (h *ShardedStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Remove deletes key from the node owning it.
+func (h *ShardedStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	var failure *BackendFailure
+	for _, i := range h.rank(key) {
+		node := h.nodes[i].node
+		ok, err := node.Remove(ctx, key)
+		if !h.report(i, err) {
+			if err != nil {
+				return false, wrappedFailure(node, err)
+			}
+			return ok, nil
+		}
+		if failure == nil {
+			failure = wrappedFailure(node, err)
+		}
+	}
+	return false, h.exhausted(failure)
+}
+
+// Stat looks key up on the node owning it, failing over like Get.
+func (h *ShardedStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	var failure *BackendFailure
+	for _, i := range h.rank(key) {
+		node := h.nodes[i].node
+		info, err := node.Stat(ctx, key)
+		if !h.report(i, err) {
+			if err != nil {
+				return ObjectInfo{}, wrappedFailure(node, err)
+			}
+			return info, nil
+		}
+		if failure == nil {
+			failure = wrappedFailure(node, err)
+		}
+	}
+	return ObjectInfo{}, h.exhausted(failure)
+}
+
+// exhausted returns the failure to report once all nodes failed.
+func (h *ShardedStorageBackend) exhausted(first *BackendFailure) *BackendFailure {
+	if first == nil {
+		return &BackendFailure{Message: "No shards configured", Code: LOCAL_ERR}
+	}
+	return &BackendFailure{
+		Message: fmt.Sprintf("All %d shards failed, first error: %s", len(h.nodes), first.Message),
+		Code:    first.Code,
+		class:   first.class}
+}
+
+func (h *ShardedStorageBackend) Drain() {
+	for _, n := range h.nodes {
+		drain(n.node)
+	}
+}
@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"testing"
+)
+
+// downBackend fails every request like an unreachable server.
+type downBackend struct {
+	calls int
+}
+
+func (d *downBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	d.calls++
+	return nil, 0, &BackendFailure{Message: "connection refused", Code: 503}
+}
+
+func (d *downBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	d.calls++
+	return false, &BackendFailure{Message: "connection refused", Code: 503}
+}
+
+func (d *downBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	d.calls++
+	return false, &BackendFailure{Message: "connection refused", Code: 503}
+}
+
+func (d *downBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	d.calls++
+	return false, &BackendFailure{Message: "connection refused", Code: 503}
+}
+
+func (d *downBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	d.calls++
+	return ObjectInfo{}, &BackendFailure{Message: "connection refused", Code: 503}
+}
+
+func (d *downBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveHttpStatus(code)
+}
+
+// rejectingBackend refuses every request with code, like a server rejecting
+// a bad request.
+type rejectingBackend struct {
+	code int
+}
+
+func (r *rejectingBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	return nil, 0, &BackendFailure{Message: "rejected", Code: r.code}
+}
+
+func (r *rejectingBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	return false, &BackendFailure{Message: "rejected", Code: r.code}
+}
+
+func (r *rejectingBackend) PutStream(ctx context.Context, key []byte, body io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return false, &BackendFailure{Message: "rejected", Code: r.code}
+}
+
+func (r *rejectingBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	return false, &BackendFailure{Message: "rejected", Code: r.code}
+}
+
+func (r *rejectingBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	return ObjectInfo{}, &BackendFailure{Message: "rejected", Code: r.code}
+}
+
+func (r *rejectingBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveHttpStatus(code)
+}
+
+func newShardNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("http://cache-%d.example.com", i)
+	}
+	return names
+}
+
+func TestShardedStorageBackend_Rebalance(t *testing.T) {
+	const keys = 10000
+	four := NewShardedBackend(newShardNames(4), make([]Backend, 4), nil)
+	five := NewShardedBackend(newShardNames(5), make([]Backend, 5), nil)
+
+	moved := 0
+	perNode := make([]int, 5)
+	for i := range keys {
+		key := binary.BigEndian.AppendUint64(nil, uint64(i))
+		before, after := four.rank(key)[0], five.rank(key)[0]
+		if before != after {
+			moved++
+			if after != 4 {
+				t.Fatalf("key %d moved between existing nodes %d and %d", i, before, after)
+			}
+		}
+		perNode[after]++
+	}
+
+	// About 1/5 of the keys should move to the new node.
+	if moved < keys/5*8/10 || moved > keys/5*12/10 {
+		t.Errorf("%d of %d keys moved, want about %d", moved, keys, keys/5)
+	}
+	for i, n := range perNode {
+		if n < keys/5*8/10 || n > keys/5*12/10 {
+			t.Errorf("node %d owns %d of %d keys", i, n, keys)
+		}
+	}
+}
+
+func TestShardedStorageBackend_Failover(t *testing.T) {
+	names := newShardNames(3)
+	nodes := make([]Backend, len(names))
+	down := &downBackend{}
+	for i := range nodes {
+		nodes[i] = NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	}
+
+	shards := NewShardedBackend(names, nodes, nil)
+	key := []byte{0x01, 0x02, 0x03}
+	owner := shards.rank(key)[0]
+	shards.nodes[owner].node = down
+
+	if ok, err := shards.Put(t.Context(), key, []byte("value"), false); !ok || err != nil {
+		t.Fatalf("Put() with owner down = %v, %v", ok, err)
+	}
+	if data := readAll(t, shards, key); string(data) != "value" {
+		t.Errorf("Get() with owner down = %q, want \"value\"", data)
+	}
+
+	// The failed node is skipped until the retry interval expired.
+	if down.calls != 1 {
+		t.Errorf("unhealthy node was called %d times, want 1", down.calls)
+	}
+	if shards.rank(key)[len(names)-1] != owner {
+		t.Errorf("unhealthy node should be ranked last")
+	}
+
+	missing := []byte{0x04, 0x05, 0x06}
+	if _, _, err := shards.Get(t.Context(), missing); err == nil {
+		t.Fatal("Get() of missing key should fail")
+	} else if code := shards.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+		t.Errorf("Get() miss resolved to %d, want NO_FILE", code)
+	}
+}
+
+func TestShardedStorageBackend_RequestErrors(t *testing.T) {
+	names := newShardNames(3)
+	nodes := make([]Backend, len(names))
+	for i := range nodes {
+		nodes[i] = NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	}
+	shards := NewShardedBackend(names, nodes, nil)
+
+	// A key too short to be stored is a local error on every node.
+	if _, err := shards.Put(t.Context(), []byte{0x01}, []byte("value"), false); err == nil {
+		t.Error("Put() of a short key should fail")
+	}
+
+	key := []byte{0x01, 0x02, 0x03}
+	owner := shards.rank(key)[0]
+	for _, code := range []int{403, 413} {
+		shards.nodes[owner].node = &rejectingBackend{code: code}
+		if _, err := shards.Put(t.Context(), key, []byte("value"), false); err == nil {
+			t.Errorf("Put() rejected with %d should fail", code)
+		}
+	}
+
+	if len(shards.unhealthy) != 0 {
+		t.Errorf("rejected requests marked %d nodes unhealthy, want 0", len(shards.unhealthy))
+	}
+	if shards.rank(key)[0] != owner {
+		t.Error("rejected requests moved the key to another node")
+	}
+}
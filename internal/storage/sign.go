@@ -0,0 +1,186 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const signMinSecretSize = 16
+
+// signMagic starts every object written by the signing layer. It is
+// followed by the HMAC-SHA256 of the cache key and the value.
+var signMagic = []byte{'c', 'A', 's', 0x01}
+
+// SignatureStats counts the verifications of a SignedStorageBackend.
+type SignatureStats struct {
+	Verified int64
+	Rejected int64
+}
+
+// SignedStorageBackend stores values with an HMAC over key and value, so
+// only holders of the shared secret can write entries which are accepted.
+type SignedStorageBackend struct {
+	inner      Backend
+	secret     []byte
+	verifyOnly bool
+
+	verified atomic.Int64
+	rejected atomic.Int64
+}
+
+// NewSignedBackend wraps inner with HMAC-SHA256 signatures using the secret
+// read from the file named by the "signing-key-file" attribute or the
+// environment variable named by "signing-key-env".
+//
+// With "signing-mode" set to "verify" entries are only verified and Put
+// stores nothing, for clients which must not publish entries. The default
+// "sign" signs and verifies.
+func NewSignedBackend(inner Backend, attributes []Attribute) (*SignedStorageBackend, error) {
+	var secret string
+	if file := findAttribute(attributes, "signing-key-file"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key: %v", err)
+		}
+		secret = string(data)
+	} else if name := findAttribute(attributes, "signing-key-env"); name != "" {
+		secret = os.Getenv(name)
+	}
+
+	secret = strings.TrimSpace(secret)
+	if len(secret) < signMinSecretSize {
+		return nil, fmt.Errorf("signing key must be at least %d bytes", signMinSecretSize)
+	}
+
+	h := &SignedStorageBackend{inner: inner, secret: []byte(secret)}
+	switch mode := findAttribute(attributes, "signing-mode"); mode {
+	case "", "sign":
+	case "verify":
+		h.verifyOnly = true
+	default:
+		return nil, fmt.Errorf("signing mode '%s' not known", mode)
+	}
+	return h, nil
+}
+
+// Stats returns a snapshot of the verification counters.
+func (h *SignedStorageBackend) Stats() SignatureStats {
+	return SignatureStats{
+		Verified: h.verified.Load(),
+		Rejected: h.rejected.Load(),
+	}
+}
+
+func (s SignatureStats) String() string {
+	return fmt.Sprintf("%d verified/%d rejected", s.Verified, s.Rejected)
+}
+
+func (h *SignedStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// signature returns the HMAC of key and data. The key is length prefixed,
+// so no other key and value pair has the same input.
+func (h *SignedStorageBackend) signature(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(key))))
+	mac.Write(key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Get returns the value of key once its signature is verified. Entries with
+// a missing or wrong signature are reported as a miss.
+func (h *SignedStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	body, size, err := h.inner.Get(ctx, key)
+	if err != nil {
+		return nil, 0, wrappedFailure(h.inner, err)
+	}
+	return h.decode(key, body, size)
+}
+
+// GetBatch looks up keys with a batch of the wrapped backend and decodes
+// each value found like Get.
+func (h *SignedStorageBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	return decodeBatch(ctx, h.inner, keys, concurrency, h.decode)
+}
+
+// decode returns the value of the object body read for key once its
+// signature is verified.
+func (h *SignedStorageBackend) decode(key []byte, body io.ReadCloser, size int64) (io.ReadCloser, int64, error) {
+	object, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Failed to read %x: %v", key, err),
+			Code:    ERROR}
+	}
+
+	headerSize := len(signMagic) + sha256.Size
+	if len(object) < headerSize || !bytes.HasPrefix(object, signMagic) ||
+		!hmac.Equal(object[len(signMagic):headerSize], h.signature(key, object[headerSize:])) {
+		h.rejected.Add(1)
+		LOG("Signature of %x is invalid, treating it as a miss (%s)", key, h.Stats())
+		return nil, 0, &BackendFailure{
+			Message: fmt.Sprintf("Signature of %x is invalid", key),
+			Code:    NO_FILE}
+	}
+
+	h.verified.Add(1)
+	data := object[headerSize:]
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// Put stores the signed value of key. In verify mode nothing is stored.
+func (h *SignedStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	if h.verifyOnly {
+		LOG("Not storing %x, signing mode is verify", key)
+		return false, nil
+	}
+
+	object := make([]byte, 0, len(signMagic)+sha256.Size+len(data))
+	object = append(object, signMagic...)
+	object = append(object, h.signature(key, data)...)
+	object = append(object, data...)
+
+	ok, err := h.inner.Put(ctx, key, object, onlyIfMissing)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// PutStream reads the value into memory, as its HMAC precedes it in
+// the stored object.
+func (h *SignedStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	return putBuffered(ctx, h, key, r, size, onlyIfMissing)
+}
+
+// Stat looks the value up with Get, so a value failing verification
+// isn't reported.
+func (h *SignedStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	return statByGet(ctx, h, key)
+}
+
+func (h *SignedStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	ok, err := h.inner.Remove(ctx, key)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+func (h *SignedStorageBackend) Drain() {
+	drain(h.inner)
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+)
+
+func TestSignedStorageBackend(t *testing.T) {
+	inner := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	t.Setenv("CCACHE_TEST_SECRET", "ci-runner-shared-secret")
+	attributes := []Attribute{{Key: "signing-key-env", Value: "CCACHE_TEST_SECRET"}}
+	signer, err := NewSignedBackend(inner, attributes)
+	if err != nil {
+		t.Fatalf("NewSignedBackend() failed: %v", err)
+	}
+	verifier, _ := NewSignedBackend(inner, append(attributes, Attribute{Key: "signing-mode", Value: "verify"}))
+
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+	if ok, err := signer.Put(t.Context(), key, value, false); !ok || err != nil {
+		t.Fatalf("Put() = %v, %v", ok, err)
+	}
+	if data := readAll(t, verifier, key); !bytes.Equal(data, value) {
+		t.Errorf("Get() = %q, want %q", data, value)
+	}
+
+	other := []byte{0x04, 0x05, 0x06}
+	if ok, err := verifier.Put(t.Context(), other, value, false); ok || err != nil {
+		t.Errorf("Put() in verify mode = %v, %v, want false, nil", ok, err)
+	}
+	if _, _, err := inner.Get(t.Context(), other); err == nil {
+		t.Error("Put() in verify mode stored the value")
+	}
+}
+
+func TestSignedStorageBackend_Poisoned(t *testing.T) {
+	inner := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	t.Setenv("CCACHE_TEST_SECRET", "ci-runner-shared-secret")
+	signed, _ := NewSignedBackend(inner, []Attribute{{Key: "signing-key-env", Value: "CCACHE_TEST_SECRET"}})
+
+	key, other := []byte{0x01, 0x02, 0x03}, []byte{0x04, 0x05, 0x06}
+	signed.Put(t.Context(), key, []byte("object code"), false)
+	genuine := readAll(t, inner, key)
+
+	tampered := bytes.Clone(genuine)
+	tampered[len(tampered)-1] ^= 0x01
+
+	t.Setenv("CCACHE_TEST_SECRET", "attacker-guessed-secret")
+	forger, _ := NewSignedBackend(inner, []Attribute{{Key: "signing-key-env", Value: "CCACHE_TEST_SECRET"}})
+
+	tests := []struct {
+		name  string
+		write func()
+	}{
+		{"unsigned", func() { inner.Put(t.Context(), key, []byte("malicious code"), false) }},
+		{"tampered", func() { inner.Put(t.Context(), key, tampered, false) }},
+		{"moved to another key", func() { inner.Put(t.Context(), key, readAll(t, inner, other), false) }},
+		{"signed with another secret", func() { forger.Put(t.Context(), key, []byte("malicious code"), false) }},
+	}
+
+	signed.Put(t.Context(), other, []byte("other object code"), false)
+	for _, tt := range tests {
+		tt.write()
+		_, _, err := signed.Get(t.Context(), key)
+		if err == nil {
+			t.Errorf("Get() of %s entry should fail", tt.name)
+		} else if code := signed.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+			t.Errorf("Get() of %s entry resolved to %d, want NO_FILE", tt.name, code)
+		}
+	}
+
+	if stats := signed.Stats(); stats.Rejected != int64(len(tests)) || stats.Verified != 0 {
+		t.Errorf("Stats() = %s, want 0 verified/%d rejected", stats, len(tests))
+	}
+}
+
+func TestNewSignedBackend_Invalid(t *testing.T) {
+	t.Setenv("CCACHE_TEST_SECRET", "short")
+	if _, err := NewSignedBackend(nil, []Attribute{{Key: "signing-key-env", Value: "CCACHE_TEST_SECRET"}}); err == nil {
+		t.Error("NewSignedBackend() with a short secret should fail")
+	}
+
+	t.Setenv("CCACHE_TEST_SECRET", "ci-runner-shared-secret")
+	if _, err := NewSignedBackend(nil, []Attribute{
+		{Key: "signing-key-env", Value: "CCACHE_TEST_SECRET"},
+		{Key: "signing-mode", Value: "trust"}}); err == nil {
+		t.Error("NewSignedBackend() with an unknown mode should fail")
+	}
+}
@@ -0,0 +1,368 @@
+package backend
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const tieredDefaultMaxSize = 1 << 30
+
+// TierStats counts lookups per tier of a TieredStorageBackend.
+type TierStats struct {
+	LocalHits    int64
+	LocalMisses  int64
+	RemoteHits   int64
+	RemoteMisses int64
+}
+
+type tierCounters struct {
+	localHits    atomic.Int64
+	localMisses  atomic.Int64
+	remoteHits   atomic.Int64
+	remoteMisses atomic.Int64
+}
+
+type tierEntry struct {
+	path string
+	size int64
+}
+
+// TieredStorageBackend serves lookups from a size bounded local directory
+// before asking the remote backend. Remote hits and all writes populate the
+// local tier, which evicts its least recently used entries.
+type TieredStorageBackend struct {
+	remote  Backend
+	local   *FileStorageBackend
+	maxSize int64
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+	size    int64
+
+	stats tierCounters
+}
+
+// NewTieredBackend wraps remote with a local tier configured by the
+// "local-cache-dir" and "local-cache-max-size" attributes.
+//
+// Entries already present in the directory are indexed by modification
+// time, so the recency order survives restarts of the helper.
+func NewTieredBackend(remote Backend, attributes []Attribute) *TieredStorageBackend {
+	maxSize := int64(tieredDefaultMaxSize)
+	if value := findAttribute(attributes, "local-cache-max-size"); value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			LOG("Invalid local-cache-max-size: %v", err)
+		} else {
+			maxSize = size
+		}
+	}
+
+	dir := findAttribute(attributes, "local-cache-dir")
+	h := &TieredStorageBackend{
+		remote:  remote,
+		local:   &FileStorageBackend{directory: dir, layout: subdirs},
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	h.loadIndex()
+	h.evict()
+	LOG("Local cache tier at %s holds %d bytes (max %d)", dir, h.size, h.maxSize)
+	return h
+}
+
+// Stats returns a snapshot of the hit and miss counters of both tiers.
+func (h *TieredStorageBackend) Stats() TierStats {
+	return TierStats{
+		LocalHits:    h.stats.localHits.Load(),
+		LocalMisses:  h.stats.localMisses.Load(),
+		RemoteHits:   h.stats.remoteHits.Load(),
+		RemoteMisses: h.stats.remoteMisses.Load(),
+	}
+}
+
+func (s TierStats) String() string {
+	return fmt.Sprintf("local %d hits/%d misses, remote %d hits/%d misses",
+		s.LocalHits, s.LocalMisses, s.RemoteHits, s.RemoteMisses)
+}
+
+func (h *TieredStorageBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// Get serves key from the local tier if possible. On a local miss the remote
+// value is written to the local tier first and then served from there.
+func (h *TieredStorageBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	body, size, err := h.local.Get(ctx, key)
+	if err == nil {
+		h.stats.localHits.Add(1)
+		h.touch(key, size)
+		LOG("Local tier hit (%s)", h.Stats())
+		return body, size, nil
+	}
+	h.stats.localMisses.Add(1)
+
+	body, size, err = h.remote.Get(ctx, key)
+	if err != nil {
+		if failureStatus(h.remote, err) == NO_FILE {
+			h.stats.remoteMisses.Add(1)
+		}
+		LOG("Local and remote tier miss (%s)", h.Stats())
+		return nil, 0, wrappedFailure(h.remote, err)
+	}
+	h.stats.remoteHits.Add(1)
+	LOG("Remote tier hit (%s)", h.Stats())
+
+	_, err = h.local.store(key, body, size, false)
+	body.Close()
+	if err == nil {
+		body, size, err = h.local.Get(ctx, key)
+	}
+	if err != nil {
+		// The remote body is consumed, fetch it again and bypass the local tier.
+		LOG("Failed to populate local tier: %v", err)
+		body, size, err = h.remote.Get(ctx, key)
+		if err != nil {
+			return nil, 0, wrappedFailure(h.remote, err)
+		}
+		return body, size, nil
+	}
+
+	h.track(key, size)
+	return body, size, nil
+}
+
+// GetBatch serves the keys found in the local tier and looks up the others
+// with a batch of the remote backend. The values found remotely are kept
+// in the local tier, like by Get.
+func (h *TieredStorageBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	var pending []int
+	for i, key := range keys {
+		if body, size, err := h.local.Get(ctx, key); err == nil {
+			value, err := io.ReadAll(body)
+			body.Close()
+			if err == nil {
+				h.stats.localHits.Add(1)
+				h.touch(key, size)
+				results[i].Value = value
+				continue
+			}
+		}
+		h.stats.localMisses.Add(1)
+		pending = append(pending, i)
+	}
+
+	for j, result := range getPending(ctx, h.remote, keys, pending, concurrency) {
+		key := keys[pending[j]]
+		if result.Err != nil {
+			if failureStatus(h.remote, result.Err) == NO_FILE {
+				h.stats.remoteMisses.Add(1)
+			}
+			result.Err = wrappedFailure(h.remote, result.Err)
+		} else {
+			h.stats.remoteHits.Add(1)
+			size := int64(len(result.Value))
+			if _, err := h.local.store(key, bytes.NewReader(result.Value), size, false); err != nil {
+				LOG("Failed to populate local tier: %v", err)
+			} else {
+				h.track(key, size)
+			}
+		}
+		results[pending[j]] = result
+	}
+	LOG("Batch of %d keys, %d looked up remotely (%s)", len(keys), len(pending), h.Stats())
+	return results
+}
+
+// Put writes data to the remote backend, then to the local tier if the
+// remote stored it, so the tiers never hold different values for key. The
+// result is the one of the remote backend, local failures are only logged.
+func (h *TieredStorageBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	ok, err := h.remote.Put(ctx, key, data, onlyIfMissing)
+	if err != nil {
+		return false, wrappedFailure(h.remote, err)
+	}
+	if !ok {
+		return false, nil
+	}
+
+	if _, err := h.local.store(key, bytes.NewReader(data), int64(len(data)), false); err != nil {
+		LOG("Failed to write local tier: %v", err)
+	} else {
+		h.track(key, int64(len(data)))
+	}
+	return true, nil
+}
+
+// PutStream writes the value read from r to the local tier, then sends the
+// local copy to the remote backend. Unlike Put, a local failure fails the
+// write, as the value is consumed. The local copy is dropped again unless
+// the remote stored it.
+func (h *TieredStorageBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	if _, err := h.local.PutStream(ctx, key, r, size, false); err != nil {
+		return false, wrappedFailure(h.local, err)
+	}
+	h.track(key, size)
+
+	body, size, err := h.local.Get(ctx, key)
+	if err != nil {
+		h.discard(key)
+		return false, wrappedFailure(h.local, err)
+	}
+	ok, err := h.remote.PutStream(ctx, key, body, size, onlyIfMissing)
+	body.Close()
+	if err != nil || !ok {
+		h.discard(key)
+	}
+	if err != nil {
+		return false, wrappedFailure(h.remote, err)
+	}
+	return ok, nil
+}
+
+// discard removes key from the local tier.
+func (h *TieredStorageBackend) discard(key []byte) {
+	if path, err := h.local.getEntryPath(key); err == nil {
+		os.Remove(path)
+		h.forget(path)
+	}
+}
+
+// Remove deletes key from both tiers, reporting the remote result.
+func (h *TieredStorageBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	h.discard(key)
+
+	ok, err := h.remote.Remove(ctx, key)
+	if err != nil {
+		return false, wrappedFailure(h.remote, err)
+	}
+	return ok, nil
+}
+
+// Stat describes the value from the local tier, falling back to the remote
+// one. Unlike Get, it doesn't populate the local tier.
+func (h *TieredStorageBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	if info, err := h.local.Stat(ctx, key); err == nil {
+		return info, nil
+	}
+
+	info, err := h.remote.Stat(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, wrappedFailure(h.remote, err)
+	}
+	return info, nil
+}
+
+// loadIndex indexes the entries present in the local directory.
+func (h *TieredStorageBackend) loadIndex() {
+	type found struct {
+		tierEntry
+		modTime time.Time
+	}
+	var files []found
+
+	filepath.WalkDir(h.local.directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			os.Remove(path) // left over from an interrupted write
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, found{tierEntry{path, info.Size()}, info.ModTime()})
+		}
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, f := range files {
+		h.entries[f.path] = h.lru.PushFront(&f.tierEntry)
+		h.size += f.size
+	}
+}
+
+// track records a used or freshly written entry and evicts old ones if needed.
+func (h *TieredStorageBackend) track(key []byte, size int64) {
+	path, err := h.local.getEntryPath(key)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	if elem, ok := h.entries[path]; ok {
+		entry := elem.Value.(*tierEntry)
+		h.size += size - entry.size
+		entry.size = size
+		h.lru.MoveToFront(elem)
+	} else {
+		h.entries[path] = h.lru.PushFront(&tierEntry{path, size})
+		h.size += size
+	}
+	h.mu.Unlock()
+
+	h.evict()
+}
+
+// touch marks key as recently used, on disk as well for the next start.
+func (h *TieredStorageBackend) touch(key []byte, size int64) {
+	if path, err := h.local.getEntryPath(key); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	h.track(key, size)
+}
+
+func (h *TieredStorageBackend) forget(path string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if elem, ok := h.entries[path]; ok {
+		h.size -= elem.Value.(*tierEntry).size
+		h.lru.Remove(elem)
+		delete(h.entries, path)
+	}
+}
+
+// evict removes least recently used entries until the tier fits maxSize.
+func (h *TieredStorageBackend) evict() {
+	h.mu.Lock()
+	var victims []string
+	for h.size > h.maxSize && h.lru.Len() > 0 {
+		entry := h.lru.Remove(h.lru.Back()).(*tierEntry)
+		delete(h.entries, entry.path)
+		h.size -= entry.size
+		victims = append(victims, entry.path)
+	}
+	h.mu.Unlock()
+
+	for _, path := range victims {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			LOG("Failed to evict %s: %v", path, err)
+		}
+	}
+}
+
+func (h *TieredStorageBackend) Drain() {
+	drain(h.remote)
+}
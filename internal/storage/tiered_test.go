@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func newTieredTestBackend(t *testing.T, maxSize string) (*TieredStorageBackend, *FileStorageBackend) {
+	remote := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	tiered := NewTieredBackend(remote, []Attribute{
+		{Key: "local-cache-dir", Value: t.TempDir()},
+		{Key: "local-cache-max-size", Value: maxSize},
+	})
+	return tiered, remote
+}
+
+func readAll(t *testing.T, backend Backend, key []byte) []byte {
+	t.Helper()
+	body, size, err := backend.Get(t.Context(), key)
+	if err != nil {
+		t.Fatalf("Get(%x) failed: %v", key, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil || int64(len(data)) != size {
+		t.Fatalf("Get(%x) returned %d bytes (size %d, err %v)", key, len(data), size, err)
+	}
+	return data
+}
+
+func TestTieredStorageBackend_Get(t *testing.T) {
+	tiered, remote := newTieredTestBackend(t, "1M")
+	key := []byte{0x01, 0x02, 0x03}
+
+	if _, _, err := tiered.Get(t.Context(), key); err == nil {
+		t.Fatal("Get() on empty tiers should fail")
+	} else if code := tiered.ResolveProtocolCode(err.(*BackendFailure).Code); code != NO_FILE {
+		t.Errorf("Get() miss resolved to %d, want NO_FILE", code)
+	}
+
+	remote.Put(t.Context(), key, []byte("value"), false)
+	if data := readAll(t, tiered, key); string(data) != "value" {
+		t.Errorf("Get() from remote = %q, want \"value\"", data)
+	}
+
+	// The entry is served locally even after it vanished remotely.
+	remote.Remove(t.Context(), key)
+	if data := readAll(t, tiered, key); string(data) != "value" {
+		t.Errorf("Get() from local tier = %q, want \"value\"", data)
+	}
+
+	want := TierStats{LocalHits: 1, LocalMisses: 2, RemoteHits: 1, RemoteMisses: 1}
+	if stats := tiered.Stats(); stats != want {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestTieredStorageBackend_PutOnlyIfMissing(t *testing.T) {
+	tiered, remote := newTieredTestBackend(t, "1M")
+	key, other := []byte{0x01, 0x02, 0x03}, []byte{0x01, 0x02, 0x04}
+	remote.Put(t.Context(), key, []byte("remote"), false)
+	remote.Put(t.Context(), other, []byte("remote"), false)
+
+	if ok, err := tiered.Put(t.Context(), key, []byte("local"), true); ok || err != nil {
+		t.Errorf("Put() of an existing key = %v, %v", ok, err)
+	}
+	if ok, err := tiered.PutStream(t.Context(), other, bytes.NewReader([]byte("local")), 5, true); ok || err != nil {
+		t.Errorf("PutStream() of an existing key = %v, %v", ok, err)
+	}
+
+	// The local tier doesn't keep the refused values.
+	remote.Remove(t.Context(), key)
+	remote.Remove(t.Context(), other)
+	for _, key := range [][]byte{key, other} {
+		if _, _, err := tiered.Get(t.Context(), key); err == nil {
+			t.Errorf("Get(%x) served a value the remote refused", key)
+		}
+	}
+}
+
+func TestTieredStorageBackend_Evict(t *testing.T) {
+	tiered, remote := newTieredTestBackend(t, "250")
+	value := bytes.Repeat([]byte("x"), 100)
+	keys := [][]byte{{0x01, 0x01}, {0x02, 0x02}, {0x03, 0x03}}
+
+	tiered.Put(t.Context(), keys[0], value, false)
+	tiered.Put(t.Context(), keys[1], value, false)
+	readAll(t, tiered, keys[0]) // keys[1] is now least recently used
+	tiered.Put(t.Context(), keys[2], value, false)
+
+	for i, evicted := range []bool{false, true, false} {
+		path, _ := tiered.local.getEntryPath(keys[i])
+		if _, err := os.Stat(path); os.IsNotExist(err) != evicted {
+			t.Errorf("key %x evicted = %v, want %v", keys[i], !evicted, evicted)
+		}
+	}
+	if tiered.size != 200 {
+		t.Errorf("local tier size = %d, want 200", tiered.size)
+	}
+
+	// Evicted entries are still available from the remote.
+	if _, _, err := remote.Get(t.Context(), keys[1]); err != nil {
+		t.Errorf("remote lost evicted entry: %v", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"512", 512},
+		{"10k", 10000},
+		{"2M", 2000000},
+		{"1Gi", 1 << 30},
+		{"3Ki", 3 << 10},
+	}
+
+	for _, tt := range tests {
+		if got, err := parseSize(tt.value); err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+	if _, err := parseSize("lots"); err == nil {
+		t.Error("parseSize(\"lots\") should fail")
+	}
+}
@@ -0,0 +1,559 @@
+package backend
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	//lint:ignore ST1001 for clean LOG operations
+	. "ccache-backend-client/internal/logger"
+)
+
+const (
+	writeBehindDefaultWorkers       = 4
+	writeBehindDefaultQueueSize     = 64 << 20
+	writeBehindDefaultSpillMaxSize  = 1 << 30
+	writeBehindDefaultUploadTimeout = time.Minute
+	writeBehindDefaultDrainTimeout  = 5 * time.Minute
+)
+
+// WriteBehindStats counts the writes of a WriteBehindBackend.
+type WriteBehindStats struct {
+	Queued  int64
+	Spilled int64
+	Written int64
+	Failed  int64
+}
+
+type writeBehindCounters struct {
+	queued  atomic.Int64
+	spilled atomic.Int64
+	written atomic.Int64
+	failed  atomic.Int64
+}
+
+// writeJob is a queued Put. Its value is either held in data or spilled to
+// the file at path.
+type writeJob struct {
+	key           []byte
+	data          []byte
+	path          string
+	size          int64
+	onlyIfMissing bool
+	canceled      bool
+}
+
+// WriteBehindBackend acknowledges Puts once they are queued and uploads
+// them with a pool of workers, so compilations don't wait for uploads.
+//
+// Queued values are held in memory up to a size limit, then spilled to a
+// directory up to another one. Once both are full, Put blocks until the
+// workers made room. Gets of a queued key are served from the queue. Once
+// drained, Puts are written through.
+type WriteBehindBackend struct {
+	inner         Backend
+	queueSize     int64
+	spillDir      string
+	spillMaxSize  int64
+	uploadTimeout time.Duration
+	drainTimeout  time.Duration
+
+	mu        sync.Mutex
+	changed   *sync.Cond // signalled whenever a job is queued or completed
+	queue     *list.List
+	pending   map[string]*writeJob // latest job per key
+	uploading map[string]int       // running uploads per key
+	running   int
+	queued    int64 // bytes held in memory
+	spilled   int64 // bytes held in spillDir
+	spillSeq  int64
+	drained   bool
+
+	stats writeBehindCounters
+}
+
+// NewWriteBehindBackend wraps inner with a write-behind queue.
+//
+// "write-behind-workers" uploads run concurrently (default 4). Up to
+// "write-behind-queue-size" bytes are queued in memory (default 64Mi). If
+// "write-behind-spill-dir" is set, further values are written there, up to
+// "write-behind-spill-max-size" bytes (default 1Gi). Values left in that
+// directory by a previous run are queued again.
+//
+// Each upload takes at most "write-behind-upload-timeout" milliseconds
+// (default 60000), and Drain waits at most "write-behind-drain-timeout"
+// milliseconds (default 300000).
+func NewWriteBehindBackend(inner Backend, attributes []Attribute) *WriteBehindBackend {
+	h := &WriteBehindBackend{
+		inner:         inner,
+		queueSize:     writeBehindDefaultQueueSize,
+		spillDir:      findAttribute(attributes, "write-behind-spill-dir"),
+		spillMaxSize:  writeBehindDefaultSpillMaxSize,
+		uploadTimeout: writeBehindDefaultUploadTimeout,
+		drainTimeout:  writeBehindDefaultDrainTimeout,
+		queue:         list.New(),
+		pending:       make(map[string]*writeJob),
+		uploading:     make(map[string]int),
+	}
+	h.changed = sync.NewCond(&h.mu)
+	if value := findAttribute(attributes, "write-behind-upload-timeout"); value != "" {
+		h.uploadTimeout = parseTimeout(value)
+	}
+	if value := findAttribute(attributes, "write-behind-drain-timeout"); value != "" {
+		h.drainTimeout = parseTimeout(value)
+	}
+
+	workers := writeBehindDefaultWorkers
+	if value := findAttribute(attributes, "write-behind-workers"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			LOG("Invalid write-behind-workers '%s', using %d", value, workers)
+		} else {
+			workers = n
+		}
+	}
+	for _, attr := range []struct {
+		name  string
+		value *int64
+	}{
+		{"write-behind-queue-size", &h.queueSize},
+		{"write-behind-spill-max-size", &h.spillMaxSize},
+	} {
+		if value := findAttribute(attributes, attr.name); value != "" {
+			size, err := parseSize(value)
+			if err != nil {
+				LOG("Invalid %s: %v", attr.name, err)
+			} else {
+				*attr.value = size
+			}
+		}
+	}
+
+	if h.spillDir != "" {
+		if err := os.MkdirAll(h.spillDir, 0755); err != nil {
+			LOG("Failed to create spill directory, not spilling: %v", err)
+			h.spillDir = ""
+		} else {
+			h.recoverSpilled()
+		}
+	}
+
+	for range workers {
+		go h.work()
+	}
+	return h
+}
+
+// Stats returns a snapshot of the counters.
+func (h *WriteBehindBackend) Stats() WriteBehindStats {
+	return WriteBehindStats{
+		Queued:  h.stats.queued.Load(),
+		Spilled: h.stats.spilled.Load(),
+		Written: h.stats.written.Load(),
+		Failed:  h.stats.failed.Load(),
+	}
+}
+
+func (s WriteBehindStats) String() string {
+	return fmt.Sprintf("%d queued (%d spilled), %d written, %d failed", s.Queued, s.Spilled, s.Written, s.Failed)
+}
+
+func (h *WriteBehindBackend) ResolveProtocolCode(code int) StatusCode {
+	return resolveStatusCode(code)
+}
+
+// spillName returns the name of the file holding a spilled value. It holds
+// all there is to know about the job, so it can be queued again after a
+// restart.
+func spillName(key []byte, seq int64, onlyIfMissing bool) string {
+	mode := "put"
+	if onlyIfMissing {
+		mode = "add"
+	}
+	return fmt.Sprintf("%x.%d.%s", key, seq, mode)
+}
+
+// recoverSpilled queues the values spilled by a previous run.
+func (h *WriteBehindBackend) recoverSpilled() {
+	entries, err := os.ReadDir(h.spillDir)
+	if err != nil {
+		LOG("Failed to read spill directory: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			os.Remove(filepath.Join(h.spillDir, entry.Name())) // interrupted write
+			continue
+		}
+		parts := strings.Split(entry.Name(), ".")
+		if len(parts) != 3 {
+			continue
+		}
+		key, err := hex.DecodeString(parts[0])
+		info, infoErr := entry.Info()
+		if err != nil || infoErr != nil {
+			continue
+		}
+		if seq, err := strconv.ParseInt(parts[1], 10, 64); err == nil && seq >= h.spillSeq {
+			h.spillSeq = seq + 1
+		}
+
+		job := &writeJob{
+			key:           key,
+			path:          filepath.Join(h.spillDir, entry.Name()),
+			size:          info.Size(),
+			onlyIfMissing: parts[2] == "add",
+		}
+		h.queue.PushBack(job)
+		h.pending[string(key)] = job
+		h.spilled += job.size
+	}
+	if h.queue.Len() > 0 {
+		LOG("Queued %d values (%d bytes) spilled by a previous run", h.queue.Len(), h.spilled)
+	}
+}
+
+// Put queues the value of key and acknowledges it. If the queue is full, it
+// waits until there is room.
+func (h *WriteBehindBackend) Put(ctx context.Context, key []byte, data []byte, onlyIfMissing bool) (bool, error) {
+	return h.PutStream(ctx, key, bytes.NewReader(data), int64(len(data)), onlyIfMissing)
+}
+
+// PutStream queues the value read from r like Put. Values which don't fit
+// the memory queue are copied to the spill directory as they are read.
+func (h *WriteBehindBackend) PutStream(ctx context.Context, key []byte, r io.Reader, size int64, onlyIfMissing bool) (bool, error) {
+	// The caller may reuse the key once PutStream returns.
+	job := &writeJob{
+		key:           bytes.Clone(key),
+		size:          size,
+		onlyIfMissing: onlyIfMissing,
+	}
+
+	h.mu.Lock()
+	if h.drained {
+		// Nothing uploads the queue anymore.
+		h.mu.Unlock()
+		ok, err := h.inner.PutStream(ctx, key, r, size, onlyIfMissing)
+		if err != nil {
+			return false, wrappedFailure(h.inner, err)
+		}
+		return ok, nil
+	}
+	if _, ok := h.pending[string(job.key)]; ok && onlyIfMissing {
+		// Only the value already queued would be stored.
+		h.mu.Unlock()
+		return true, nil
+	}
+	for !h.reserve(job) {
+		LOG("Write-behind queue is full, waiting to queue %x (%s)", key, h.Stats())
+		h.changed.Wait()
+	}
+	h.mu.Unlock()
+
+	// The value may arrive slowly, it is read without holding mu.
+	if err := h.fill(job, r); err != nil {
+		h.mu.Lock()
+		h.release(job)
+		h.mu.Unlock()
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Failed to queue %x: %v", key, err),
+			Code:    0}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queue.PushBack(job)
+	h.pending[string(job.key)] = job
+	h.stats.queued.Add(1)
+	h.changed.Broadcast()
+	return true, nil
+}
+
+// reserve reserves room for job in memory, or else in the spill directory.
+// An empty queue admits a value of any size. Must be called with mu held.
+func (h *WriteBehindBackend) reserve(job *writeJob) bool {
+	if h.queued+job.size <= h.queueSize || (h.queued == 0 && h.spillDir == "") {
+		h.queued += job.size
+		return true
+	}
+	if h.spillDir == "" || (h.spilled+job.size > h.spillMaxSize && h.spilled != 0) {
+		return false
+	}
+
+	job.path = filepath.Join(h.spillDir, spillName(job.key, h.spillSeq, job.onlyIfMissing))
+	h.spillSeq++
+	h.spilled += job.size
+	return true
+}
+
+// fill reads the value of job from r into the room reserved for it. A
+// spilled value only gets its final name once complete, so an interrupted
+// write isn't queued again by the next run.
+func (h *WriteBehindBackend) fill(job *writeJob, r io.Reader) error {
+	if job.path == "" {
+		data, err := readValue(r, job.size)
+		job.data = data
+		return err
+	}
+
+	tmp := job.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, r, job.size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, job.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	h.stats.spilled.Add(1)
+	return nil
+}
+
+// release frees the room taken by job. Must be called with mu held.
+func (h *WriteBehindBackend) release(job *writeJob) {
+	if job.path != "" {
+		os.Remove(job.path)
+		h.spilled -= job.size
+	} else {
+		h.queued -= job.size
+	}
+	if h.pending[string(job.key)] == job {
+		delete(h.pending, string(job.key))
+	}
+	h.changed.Broadcast()
+}
+
+// work uploads the queued values, oldest first.
+func (h *WriteBehindBackend) work() {
+	for {
+		h.mu.Lock()
+		for h.queue.Len() == 0 {
+			h.changed.Wait()
+		}
+		job := h.queue.Remove(h.queue.Front()).(*writeJob)
+		h.running++
+		canceled := job.canceled
+		if !canceled {
+			h.uploading[string(job.key)]++
+		}
+		h.mu.Unlock()
+
+		if !canceled {
+			h.upload(job)
+		}
+
+		h.mu.Lock()
+		h.running--
+		if !canceled {
+			if h.uploading[string(job.key)]--; h.uploading[string(job.key)] == 0 {
+				delete(h.uploading, string(job.key))
+			}
+		}
+		h.release(job)
+		h.mu.Unlock()
+	}
+}
+
+// upload stores job in the wrapped backend. The request which queued it is
+// long answered, so the upload is bounded by the upload timeout instead of
+// its context. A spilled value is streamed from its file.
+func (h *WriteBehindBackend) upload(job *writeJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.uploadTimeout)
+	defer cancel()
+
+	var err error
+	if job.path == "" {
+		_, err = h.inner.Put(ctx, job.key, job.data, job.onlyIfMissing)
+	} else {
+		var f *os.File
+		if f, err = os.Open(job.path); err != nil {
+			h.stats.failed.Add(1)
+			LOG("Failed to read spilled value of %x: %v", job.key, err)
+			return
+		}
+		_, err = h.inner.PutStream(ctx, job.key, f, job.size, job.onlyIfMissing)
+		f.Close()
+	}
+	if err != nil {
+		h.stats.failed.Add(1)
+		LOG("Background upload of %x failed (%s): %v", job.key, h.Stats(), err)
+		return
+	}
+	h.stats.written.Add(1)
+}
+
+// Drain waits until the queue is empty and no upload is running, for at
+// most the drain timeout. Later Puts are written through. Values still
+// spilled when it gives up are queued again by the next run.
+func (h *WriteBehindBackend) Drain() {
+	h.mu.Lock()
+	h.drained = true
+	if h.queue.Len() > 0 || h.running > 0 {
+		LOG("Waiting for %d queued and %d running uploads", h.queue.Len(), h.running)
+	}
+	expired := false
+	timer := time.AfterFunc(h.drainTimeout, func() {
+		h.mu.Lock()
+		expired = true
+		h.changed.Broadcast()
+		h.mu.Unlock()
+	})
+	for (h.queue.Len() > 0 || h.running > 0) && !expired {
+		h.changed.Wait()
+	}
+	if expired {
+		LOG("Gave up draining after %v, %d queued and %d running uploads are left (%s)",
+			h.drainTimeout, h.queue.Len(), h.running, h.Stats())
+	}
+	h.mu.Unlock()
+	timer.Stop()
+
+	drain(h.inner)
+}
+
+// queuedValue opens the value of key if it is still queued. A spilled value
+// is read from its file.
+func (h *WriteBehindBackend) queuedValue(key []byte) (io.ReadCloser, int64, bool) {
+	h.mu.Lock()
+	job, ok := h.pending[string(key)]
+	h.mu.Unlock()
+	if !ok {
+		return nil, 0, false
+	}
+	if job.path == "" {
+		return io.NopCloser(bytes.NewReader(job.data)), job.size, true
+	}
+
+	// The file is gone if the upload completed meanwhile.
+	f, err := os.Open(job.path)
+	if err != nil {
+		return nil, 0, false
+	}
+	return f, job.size, true
+}
+
+// Get serves a value which is still queued, otherwise it asks the wrapped
+// backend.
+func (h *WriteBehindBackend) Get(ctx context.Context, key []byte) (io.ReadCloser, int64, error) {
+	if body, size, ok := h.queuedValue(key); ok {
+		return body, size, nil
+	}
+
+	body, size, err := h.inner.Get(ctx, key)
+	if err != nil {
+		return nil, 0, wrappedFailure(h.inner, err)
+	}
+	return body, size, nil
+}
+
+// GetBatch serves the values still queued and looks up the others with a
+// batch of the wrapped backend.
+func (h *WriteBehindBackend) GetBatch(ctx context.Context, keys [][]byte, concurrency int) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	var pending []int
+	for i, key := range keys {
+		body, _, ok := h.queuedValue(key)
+		if !ok {
+			pending = append(pending, i)
+			continue
+		}
+		results[i].Value, results[i].Err = io.ReadAll(body)
+		body.Close()
+	}
+
+	for j, result := range getPending(ctx, h.inner, keys, pending, concurrency) {
+		if result.Err != nil {
+			result.Err = wrappedFailure(h.inner, result.Err)
+		}
+		results[pending[j]] = result
+	}
+	return results
+}
+
+// Remove cancels the queued uploads of key, waits for those running, within
+// the deadline of ctx, and removes it from the wrapped backend.
+func (h *WriteBehindBackend) Remove(ctx context.Context, key []byte) (bool, error) {
+	stop := context.AfterFunc(ctx, func() {
+		h.mu.Lock()
+		h.changed.Broadcast()
+		h.mu.Unlock()
+	})
+	defer stop()
+
+	h.mu.Lock()
+	for e := h.queue.Front(); e != nil; e = e.Next() {
+		if job := e.Value.(*writeJob); bytes.Equal(job.key, key) {
+			job.canceled = true
+		}
+	}
+	delete(h.pending, string(key))
+	for h.uploading[string(key)] > 0 && ctx.Err() == nil {
+		h.changed.Wait()
+	}
+	uploading := h.uploading[string(key)] > 0
+	h.mu.Unlock()
+
+	if uploading {
+		// The upload would store the value again after it was removed.
+		return false, &BackendFailure{
+			Message: fmt.Sprintf("Upload of %x still running: %v", key, ctx.Err()),
+			Code:    TIMEOUT}
+	}
+
+	ok, err := h.inner.Remove(ctx, key)
+	if err != nil {
+		return false, wrappedFailure(h.inner, err)
+	}
+	return ok, nil
+}
+
+// Stat describes a value which is still queued, otherwise it asks the
+// wrapped backend.
+func (h *WriteBehindBackend) Stat(ctx context.Context, key []byte) (ObjectInfo, error) {
+	if info, ok := h.queuedInfo(key); ok {
+		return info, nil
+	}
+
+	info, err := h.inner.Stat(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, wrappedFailure(h.inner, err)
+	}
+	return info, nil
+}
+
+// queuedInfo describes the value queued for key, if any.
+func (h *WriteBehindBackend) queuedInfo(key []byte) (ObjectInfo, bool) {
+	h.mu.Lock()
+	job, ok := h.pending[string(key)]
+	h.mu.Unlock()
+	if !ok {
+		return ObjectInfo{}, false
+	}
+	if job.path == "" {
+		return ObjectInfo{Size: int64(len(job.data))}, true
+	}
+
+	// The file is gone if the upload completed meanwhile.
+	info, err := os.Stat(job.path)
+	if err != nil {
+		return ObjectInfo{}, false
+	}
+	return ObjectInfo{Size: info.Size(), LastModified: info.ModTime()}, true
+}
@@ -0,0 +1,189 @@
+package backend
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteBehindBackend(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	gated := newGatedBackend(files)
+	writeBehind := NewWriteBehindBackend(gated, []Attribute{{Key: "write-behind-workers", Value: "1"}})
+
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+	buffer := bytes.Clone(value)
+	if ok, err := writeBehind.Put(t.Context(), key, buffer, false); !ok || err != nil {
+		t.Fatalf("Put() = %v, %v", ok, err)
+	}
+	copy(buffer, "reused buffer")
+
+	// The upload is held, the value is served from the queue.
+	<-gated.entered
+	if data := readAll(t, writeBehind, key); !bytes.Equal(data, value) {
+		t.Errorf("Get() of a queued value = %q, want %q", data, value)
+	}
+	if info, err := writeBehind.Stat(t.Context(), key); err != nil || info.Size != int64(len(value)) {
+		t.Errorf("Stat() of a queued value = %+v, %v", info, err)
+	}
+
+	close(gated.release)
+	writeBehind.Drain()
+	if data := readAll(t, files, key); !bytes.Equal(data, value) {
+		t.Errorf("uploaded value = %q, want %q", data, value)
+	}
+	if stats := writeBehind.Stats(); stats.Queued != 1 || stats.Written != 1 {
+		t.Errorf("Stats() = %s", stats)
+	}
+}
+
+func TestWriteBehindBackend_Backpressure(t *testing.T) {
+	gated := newGatedBackend(NewFileBackend(&url.URL{Path: t.TempDir()}, nil))
+	spillDir := t.TempDir()
+	writeBehind := NewWriteBehindBackend(gated, []Attribute{
+		{Key: "write-behind-workers", Value: "1"},
+		{Key: "write-behind-queue-size", Value: "8"},
+		{Key: "write-behind-spill-dir", Value: spillDir},
+		{Key: "write-behind-spill-max-size", Value: "16"},
+	})
+
+	value := []byte("8 bytes!")
+	for i := range 3 {
+		// One in flight, holding the memory queue, two spilled.
+		writeBehind.Put(t.Context(), []byte{byte(i), 0x01}, value, false)
+		if i == 0 {
+			<-gated.entered
+		}
+	}
+	if spilled, _ := os.ReadDir(spillDir); len(spilled) != 2 {
+		t.Errorf("%d values spilled, want 2", len(spilled))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		writeBehind.Put(t.Context(), []byte{0x04, 0x01}, value, false)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Put() into a full queue should wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(gated.release)
+	<-done
+	writeBehind.Drain()
+	if stats := writeBehind.Stats(); stats.Written != 4 || stats.Spilled < 2 {
+		t.Errorf("Stats() = %s, want 4 written", stats)
+	}
+	if spilled, _ := os.ReadDir(spillDir); len(spilled) != 0 {
+		t.Errorf("%d spilled values left after Drain()", len(spilled))
+	}
+}
+
+func TestWriteBehindBackend_Recover(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	spillDir := t.TempDir()
+	key, value := []byte{0x01, 0x02, 0x03}, []byte("object code")
+	os.WriteFile(filepath.Join(spillDir, spillName(key, 7, false)), value, 0644)
+
+	writeBehind := NewWriteBehindBackend(files, []Attribute{{Key: "write-behind-spill-dir", Value: spillDir}})
+	writeBehind.Drain()
+	if data := readAll(t, files, key); !bytes.Equal(data, value) {
+		t.Errorf("value spilled by a previous run = %q, want %q", data, value)
+	}
+}
+
+func TestWriteBehindBackend_Remove(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	gated := newGatedBackend(files)
+	writeBehind := NewWriteBehindBackend(gated, []Attribute{{Key: "write-behind-workers", Value: "1"}})
+
+	first, key := []byte{0x01, 0x01}, []byte{0x01, 0x02, 0x03}
+	writeBehind.Put(t.Context(), first, []byte("object code"), false)
+	<-gated.entered
+	writeBehind.Put(t.Context(), key, []byte("object code"), false)
+	writeBehind.Remove(t.Context(), key)
+
+	close(gated.release)
+	writeBehind.Drain()
+	if _, _, err := writeBehind.Get(t.Context(), key); err == nil {
+		t.Error("Get() of a removed key should fail")
+	}
+}
+
+func TestWriteBehindBackend_RemoveInFlight(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	gated := newGatedBackend(files)
+	writeBehind := NewWriteBehindBackend(gated, []Attribute{{Key: "write-behind-workers", Value: "1"}})
+
+	key := []byte{0x01, 0x02, 0x03}
+	writeBehind.Put(t.Context(), key, []byte("object code"), false)
+	<-gated.entered
+
+	done := make(chan struct{})
+	go func() {
+		writeBehind.Remove(t.Context(), key)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Remove() should wait for the running upload of the key")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(gated.release)
+	<-done
+	writeBehind.Drain()
+	if _, _, err := files.Get(t.Context(), key); err == nil {
+		t.Error("the upload running during Remove() stored the value again")
+	}
+}
+
+func TestWriteBehindBackend_Drain(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	gated := newGatedBackend(files)
+	writeBehind := NewWriteBehindBackend(gated, []Attribute{
+		{Key: "write-behind-workers", Value: "1"},
+		{Key: "write-behind-drain-timeout", Value: "50"},
+	})
+
+	writeBehind.Put(t.Context(), []byte{0x01, 0x01}, []byte("object code"), false)
+	<-gated.entered
+	start := time.Now()
+	writeBehind.Drain()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Drain() took %v despite a drain timeout of 50ms", elapsed)
+	}
+
+	// Once drained, writes are no longer queued.
+	key, value := []byte{0x01, 0x02}, []byte("late write")
+	if ok, err := writeBehind.Put(t.Context(), key, value, false); !ok || err != nil {
+		t.Fatalf("Put() after Drain() = %v, %v", ok, err)
+	}
+	if data := readAll(t, files, key); !bytes.Equal(data, value) {
+		t.Errorf("value written after Drain() = %q, want %q", data, value)
+	}
+
+	// Let the abandoned upload finish before the directory is removed.
+	close(gated.release)
+	for writeBehind.Stats().Written == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteBehindBackend_UploadTimeout(t *testing.T) {
+	files := NewFileBackend(&url.URL{Path: t.TempDir()}, nil)
+	writeBehind := NewWriteBehindBackend(&stuckBackend{files}, []Attribute{
+		{Key: "write-behind-upload-timeout", Value: "50"},
+	})
+
+	writeBehind.Put(t.Context(), []byte{0x01, 0x01}, []byte("object code"), false)
+	writeBehind.Drain()
+	if stats := writeBehind.Stats(); stats.Failed != 1 {
+		t.Errorf("Stats() = %s, want the stuck upload failed", stats)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"ccache-backend-client/internal/constants"
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
 var (
@@ -27,6 +28,9 @@ type MessageHeader struct {
 type Message struct {
 	Type   uint16
 	Fields []TLVField
+	// Value streams the value field if it wasn't complete when the message
+	// was parsed, see Parser.ParseStream.
+	Value io.Reader
 }
 
 // FindField finds the first field with the given type
@@ -1,6 +1,7 @@
 package tlv
 
 import (
+	"bytes"
 	"ccache-backend-client/internal/constants"
 	"encoding/binary"
 	"fmt"
@@ -67,7 +68,7 @@ func decodeLength(buf []byte) (uint64, int, error) {
 		if len(buf) < 9 {
 			return 0, 0, constants.ErrTruncatedData
 		}
-		length := binary.LittleEndian.Uint64(buf[1:5])
+		length := binary.LittleEndian.Uint64(buf[1:9])
 		return length, 9, nil
 	}
 
@@ -123,3 +124,79 @@ func (p *Parser) Parse(data []byte) (*Message, error) {
 		Fields: p.fields,
 	}, nil
 }
+
+// DeclaredSize returns the size of the message starting data, as far as the
+// fields received so far tell: up to the end of the last field whose header
+// is complete. It lets a receiver account for a message before reading all
+// of it.
+func DeclaredSize(data []byte) uint64 {
+	if len(data) < constants.TLVHeaderSize {
+		return uint64(len(data))
+	}
+
+	size := uint64(4)
+	for size < uint64(len(data)) {
+		length, lengthBytes, err := decodeLength(data[size+1:])
+		if err != nil {
+			return uint64(len(data))
+		}
+		size += 1 + uint64(lengthBytes) + length
+	}
+	return size
+}
+
+// ParseStream parses a message like Parse, except that a value announced as
+// the last field of the message by its header needn't be complete: its
+// first bytes are taken from data and the rest is read from rest, see
+// Message.Value. The field's Data is nil then.
+//
+// The caller must read or skip the value before reading the next message
+// from rest.
+func (p *Parser) ParseStream(data []byte, rest io.Reader) (*Message, error) {
+	if len(data) < constants.TLVHeaderSize {
+		return nil, constants.ErrInvalidMessage
+	}
+	p.fields = p.fields[:0]
+
+	numFields := int(data[1])
+	msgType := binary.LittleEndian.Uint16(data[2:4])
+	pos := 4
+
+	for pos < len(data) {
+		fieldType := data[pos]
+		pos += 1
+
+		length, lengthBytes, err := decodeLength(data[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode length: %w", err)
+		}
+		pos += lengthBytes
+
+		if uint64(pos)+uint64(length) > uint64(len(data)) {
+			if fieldType != constants.TypeValue || len(p.fields) != numFields-1 {
+				return nil, constants.ErrTruncatedData
+			}
+
+			available := data[pos:]
+			p.fields = append(p.fields, TLVField{Tag: fieldType, Length: length})
+			return &Message{
+				Type:   msgType,
+				Fields: p.fields,
+				Value: io.MultiReader(bytes.NewReader(available),
+					io.LimitReader(rest, int64(length)-int64(len(available)))),
+			}, nil
+		}
+
+		p.fields = append(p.fields, TLVField{
+			Tag:    fieldType,
+			Length: length,
+			Data:   data[pos : pos+int(length)], // Zero-copy
+		})
+		pos += int(length)
+	}
+
+	return &Message{
+		Type:   msgType,
+		Fields: p.fields,
+	}, nil
+}
@@ -3,6 +3,7 @@ package tlv
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"testing"
 
 	"ccache-backend-client/internal/constants"
@@ -449,3 +450,116 @@ func TestParser_ParseMultipleMessages(t *testing.T) {
 		t.Error("Messages should point to the same data")
 	}
 }
+
+func TestParser_ParseStream(t *testing.T) {
+	parser := NewParser()
+	value := bytes.Repeat([]byte("object code "), 100)
+	put := createTestTLVData(constants.MsgTypePut, []testField{
+		{tag: constants.TypeKey, data: []byte{0x01, 0x02, 0x03}},
+		{tag: constants.TypeFlags, data: []byte{constants.OverwriteFlag}},
+		{tag: constants.TypeValue, data: value},
+	})
+	next := createTestTLVData(constants.MsgTypeGet, []testField{
+		{tag: constants.TypeKey, data: []byte{0x04, 0x05, 0x06}},
+	})
+
+	// Only the first bytes of the value have been read from the connection.
+	split := len(put) - len(value) + 10
+	rest := bytes.NewReader(append(bytes.Clone(put[split:]), next...))
+
+	msg, err := parser.ParseStream(put[:split], rest)
+	if err != nil {
+		t.Fatalf("ParseStream() failed: %v", err)
+	}
+	if msg.Value == nil {
+		t.Fatal("ParseStream() should stream the incomplete value")
+	}
+	if key := msg.FindField(constants.TypeKey); key == nil || !bytes.Equal(key.Data, []byte{0x01, 0x02, 0x03}) {
+		t.Errorf("key field = %v", key)
+	}
+	if field := msg.FindField(constants.TypeValue); field == nil || field.Length != uint64(len(value)) {
+		t.Errorf("value field = %v, want length %d", field, len(value))
+	}
+
+	streamed, _ := io.ReadAll(msg.Value)
+	if !bytes.Equal(streamed, value) {
+		t.Errorf("streamed %d bytes, want the %d bytes of the value", len(streamed), len(value))
+	}
+	if remaining, _ := io.ReadAll(rest); !bytes.Equal(remaining, next) {
+		t.Error("streaming the value should leave the next message unread")
+	}
+}
+
+func TestParser_ParseStreamComplete(t *testing.T) {
+	parser := NewParser()
+	data := createTestTLVData(constants.MsgTypePut, []testField{
+		{tag: constants.TypeKey, data: []byte{0x01, 0x02, 0x03}},
+		{tag: constants.TypeValue, data: []byte("object code")},
+	})
+
+	msg, err := parser.ParseStream(data, bytes.NewReader(nil))
+	if err != nil || msg.Value != nil {
+		t.Fatalf("ParseStream() of a complete message = %v, %v", msg, err)
+	}
+	if value := msg.FindField(constants.TypeValue); string(value.Data) != "object code" {
+		t.Errorf("value = %q", value.Data)
+	}
+}
+
+func TestParser_ParseStreamTruncated(t *testing.T) {
+	parser := NewParser()
+	value := bytes.Repeat([]byte{0xAB}, 300)
+
+	tests := []struct {
+		name   string
+		fields []testField
+	}{
+		{"value not last", []testField{
+			{tag: constants.TypeValue, data: value},
+			{tag: constants.TypeKey, data: []byte{0x01, 0x02, 0x03}},
+		}},
+		{"other field", []testField{
+			{tag: constants.TypeKey, data: value},
+		}},
+	}
+
+	for _, tt := range tests {
+		data := createTestTLVData(constants.MsgTypePut, tt.fields)
+		if _, err := parser.ParseStream(data[:20], bytes.NewReader(data[20:])); err != constants.ErrTruncatedData {
+			t.Errorf("ParseStream() with %s = %v, want %v", tt.name, err, constants.ErrTruncatedData)
+		}
+	}
+}
+
+func TestDeclaredSize(t *testing.T) {
+	value := bytes.Repeat([]byte{0xAB}, 300)
+	data := createTestTLVData(constants.MsgTypePut, []testField{
+		{tag: constants.TypeValue, data: value},
+		{tag: constants.TypeKey, data: []byte{0x01, 0x02, 0x03}},
+	})
+
+	tests := []struct {
+		received int
+		want     uint64
+	}{
+		{2, 2},                      // incomplete message header
+		{5, 5},                      // incomplete field header
+		{20, uint64(len(data)) - 5}, // value announced, key not yet
+		{len(data) - 1, uint64(len(data))},
+		{len(data), uint64(len(data))},
+	}
+	for _, tt := range tests {
+		if size := DeclaredSize(data[:tt.received]); size != tt.want {
+			t.Errorf("DeclaredSize() of %d bytes = %d, want %d", tt.received, size, tt.want)
+		}
+	}
+}
+
+func TestDecodeLength9Byte(t *testing.T) {
+	buf := make([]byte, 9)
+	encodeLength(buf, 1<<40)
+	length, n, err := decodeLength(buf)
+	if err != nil || n != 9 || length != 1<<40 {
+		t.Errorf("decodeLength() = %d, %d, %v, want %d, 9, nil", length, n, err, uint64(1<<40))
+	}
+}
@@ -23,6 +23,9 @@ func GetSerializer() *Serializer {
 }
 
 func PutSerializer(s *Serializer) {
+	if cap(s.buffer) > constants.MAX_POOLED_BUFFER_SIZE {
+		return // let a large buffer be collected
+	}
 	s.Reset()
 	serializerPool.Put(s)
 }
@@ -133,6 +136,13 @@ func (s *Serializer) AddUint32Field(fieldTag uint8, value uint32) error {
 	return s.addFieldInternal(fieldTag, data)
 }
 
+// AddUint64Field adds a uint64 field
+func (s *Serializer) AddUint64Field(fieldTag uint8, value uint64) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+	return s.addFieldInternal(fieldTag, data)
+}
+
 // addFieldInternal handles the actual field serialization
 func (s *Serializer) addFieldInternal(fieldTag uint8, data []byte) error {
 	dataLen := uint64(len(data))
@@ -225,18 +235,13 @@ func (s *Serializer) Finalize(conn net.Conn, rc io.ReadCloser, size uint64) erro
 
 	conn.Write(s.Bytes())
 	written, err := io.CopyN(conn, rc, int64(size))
-	if err != nil {
-		LOG("Error writing to socket!")
-		return err
-	}
-	if uint64(written) != size {
-		LOG("Write interrupted!")
-	}
-
-	err = rc.Close()
+	closeErr := rc.Close()
 	s.Reset()
 	if err != nil {
+		// The header announced size bytes, the connection must not be
+		// used for further messages.
+		LOG("Write interrupted after %d of %d bytes: %v", written, size, err)
 		return err
 	}
-	return nil
+	return closeErr
 }
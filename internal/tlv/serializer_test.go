@@ -1,7 +1,10 @@
 package tlv
 
 import (
+	"bytes"
 	"ccache-backend-client/internal/constants"
+	"io"
+	"net"
 	"testing"
 )
 
@@ -55,3 +58,31 @@ func TestAddFieldInternal(t *testing.T) {
 		})
 	}
 }
+
+func TestFinalizeShortValue(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, client)
+
+	value := &closeRecorder{Reader: bytes.NewReader([]byte("short"))}
+	s := NewSerializer(1024)
+	s.BeginMessage(1, 1, constants.MsgTypeGetResponse)
+	s.AddUint8Field(constants.TypeStatusCode, constants.SUCCESS)
+
+	if err := s.Finalize(server, value, 100); err == nil {
+		t.Error("Finalize() of a value shorter than announced should fail")
+	}
+	if !value.closed {
+		t.Error("Finalize() did not close the value")
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}